@@ -19,16 +19,22 @@ package v1beta1
 import (
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // ArgonautSpec defines the desired state of Argonaut
 type ArgonautSpec struct {
 
-	// Reference to a ArgoTunnel{}. If tunnel definition
+	// Reference to a ArgoTunnel{}. If tunnel definition exists the Argonaut only contributes
+	// its ingress rules and DNS records to that shared tunnel. Otherwise the Argonaut runs a
+	// tunnel of this name on its own.
 	ArgoTunnelName string `json:"argoTunnelName"`
 
-	// Secret Reference containing the tunnel secret. If not provided the Argonaut operator
-	// will create it and populate it.
+	// Secret Reference containing credentials for an existing tunnel, either a cloudflared
+	// credentials file under tunnel.json or credentials.json, or a tunnel token under token.
+	// The tunnel is adopted as is. If not provided the Argonaut operator will create the tunnel
+	// and a Secret named after it. Must be in the Argonaut namespace. Ignored when the
+	// Argonaut uses a shared ArgoTunnel.
 	ArgoTunnelSecret v1.SecretReference `json:"argoTunnelSecret,omitempty"`
 
 	// Reference to a secret that contains email and token for CloudFlare API access.
@@ -36,14 +42,113 @@ type ArgonautSpec struct {
 
 	// List of hosts to manage for this Argonaut instance.
 	Ingress []ArgonautIngressRule `json:"ingress"`
+
+	// Defaults for how cloudflared connects to the origins of every ingress rule.
+	// +optional
+	OriginRequest *OriginRequest `json:"originRequest,omitempty"`
+
+	// Where requests go that no ingress rule matches. Answers 404 if not set. Not used when the
+	// Argonaut is attached to an ArgoTunnel, which has a defaultBackend of its own.
+	// +optional
+	DefaultBackend *ArgonautDefaultBackend `json:"defaultBackend,omitempty"`
+
+	// Settings for the cloudflared Deployment. Not used when the Argonaut is attached to an
+	// ArgoTunnel.
+	// +optional
+	Deployment *CloudflaredDeployment `json:"deployment,omitempty"`
+
+	// What happens to the Argo Tunnel and its DNS records when this Argonaut is deleted.
+	// Delete tears them down, Orphan leaves them and the tunnel Secret in place so the
+	// tunnel can be picked up again later. With a shared ArgoTunnel only the DNS records of
+	// this Argonaut are affected.
+	// +kubebuilder:default=Delete
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// What to do with DNS records at our hostnames that Argonaut did not create. Strict leaves
+	// them alone and reports the conflict, Adopt takes them over. Records claimed by another
+	// Argonaut are never touched.
+	// +kubebuilder:default=Strict
+	// +optional
+	OwnershipPolicy OwnershipPolicy `json:"ownershipPolicy,omitempty"`
+
+	// Which changes Argonaut makes to DNS records, like the policy of external-dns. sync creates,
+	// updates and deletes records of removed hostnames, upsert-only never deletes and
+	// create-only only creates records and keeps the ones it owns pointed at the tunnel.
+	// +kubebuilder:default=sync
+	// +optional
+	DNSPolicy DNSPolicy `json:"dnsPolicy,omitempty"`
+
+	// What to do when a hostname has records a CNAME can't live next to, such as A or AAAA
+	// records. Report leaves the hostname out and fails DNSReady, Skip leaves it out quietly and
+	// Replace deletes the records. Other hostnames are published either way.
+	// +kubebuilder:default=Report
+	// +optional
+	ConflictPolicy ConflictPolicy `json:"conflictPolicy,omitempty"`
 }
 
+// ConflictPolicy describes how records conflicting with a tunnel CNAME are handled.
+// +kubebuilder:validation:Enum=Report;Skip;Replace
+type ConflictPolicy string
+
+const (
+	// Leave the hostname out and report the conflict.
+	ConflictPolicyReport ConflictPolicy = "Report"
+
+	// Leave the hostname out without failing DNSReady.
+	ConflictPolicySkip ConflictPolicy = "Skip"
+
+	// Delete the conflicting records.
+	ConflictPolicyReplace ConflictPolicy = "Replace"
+)
+
+// DNSPolicy describes which changes are made to DNS records.
+// +kubebuilder:validation:Enum=sync;upsert-only;create-only
+type DNSPolicy string
+
+const (
+	// Create, update and delete records.
+	DNSPolicySync DNSPolicy = "sync"
+
+	// Create and update records, never delete them.
+	DNSPolicyUpsertOnly DNSPolicy = "upsert-only"
+
+	// Create records, only update the ones we own when the tunnel changes.
+	DNSPolicyCreateOnly DNSPolicy = "create-only"
+)
+
+// OwnershipPolicy describes how DNS records Argonaut did not create are handled.
+// +kubebuilder:validation:Enum=Strict;Adopt
+type OwnershipPolicy string
+
+const (
+	// Leave records we don't own alone.
+	OwnershipPolicyStrict OwnershipPolicy = "Strict"
+
+	// Take over records nobody claims.
+	OwnershipPolicyAdopt OwnershipPolicy = "Adopt"
+)
+
+// DeletionPolicy describes how Cloudflare resources are handled on Argonaut or ArgoTunnel deletion.
+// +kubebuilder:validation:Enum=Delete;Orphan
+type DeletionPolicy string
+
+const (
+	// Remove DNS records and the Argo Tunnel from Cloudflare.
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+
+	// Keep DNS records and the Argo Tunnel in Cloudflare.
+	DeletionPolicyOrphan DeletionPolicy = "Orphan"
+)
+
 // ArgonaoutHost defines a
 type ArgonautIngressRule struct {
 	// Describes the desired FQDN hostname for
 	Hostname string `json:"hostname"`
 
-	// Path on host endpoints to expose. Supports filters/wildcards.. Doc ref.
+	// Path on host endpoints to expose, as a regular expression cloudflared matches against the
+	// request path. Several rules may share a hostname with different paths, the longest path is
+	// tried first. Rules with an invalid expression are left out.
 	// +optional
 	Path string `json:"path,omitempty"`
 
@@ -51,19 +156,256 @@ type ArgonautIngressRule struct {
 	// EndpointsSelector and ServiceSelector are mutually exclusive
 	EndpointsSelector metav1.LabelSelector `json:"endpointsSelector,omitempty"`
 
-	// Service selector for finding a ClusterIP to tunnel traffic to
+	// Service selector for finding a ClusterIP to tunnel traffic to. Should select exactly one
+	// Service, the first by namespace and name is used if it selects several.
 	ServiceSelector metav1.LabelSelector `json:"serviceSelector,omitempty"`
+
+	// Port of the selected Service to tunnel traffic to, by name or number. May be left out if
+	// the Service has a single port.
+	// +optional
+	Port *intstr.IntOrString `json:"port,omitempty"`
+
+	// Service to tunnel traffic to, by name. Takes precedence over serviceSelector.
+	// +optional
+	ServiceRef *ArgonautServiceRef `json:"serviceRef,omitempty"`
+
+	// Protocol cloudflared speaks to the origin. Defaults to https for Service ports named https
+	// or with appProtocol https, http otherwise. unix, http_status and hello_world don't use a
+	// Service.
+	// +optional
+	Protocol Protocol `json:"protocol,omitempty"`
+
+	// Path of the socket for protocol unix, as seen from the cloudflared container.
+	// +optional
+	UnixSocket string `json:"unixSocket,omitempty"`
+
+	// How cloudflared connects to the origin. Fields set here override the originRequest of the
+	// Argonaut.
+	// +optional
+	OriginRequest *OriginRequest `json:"originRequest,omitempty"`
+
+	// Status code to answer with for protocol http_status. Defaults to 404.
+	// +kubebuilder:validation:Minimum=100
+	// +kubebuilder:validation:Maximum=599
+	// +optional
+	StatusCode int `json:"statusCode,omitempty"`
+
+	// Namespaces to look for Services and Endpoints in. Only the namespace of the Argonaut is
+	// searched if not set. Other namespaces need a ServiceGrant allowing this namespace.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// Settings for the DNS record of the hostname. Rules sharing a hostname share its record,
+	// only one of them needs to set these.
+	// +optional
+	DNS *ArgonautDNSOptions `json:"dns,omitempty"`
+}
+
+// ArgonautDNSOptions are settings for the DNS record of a hostname.
+type ArgonautDNSOptions struct {
+	// Whether requests go through the Cloudflare edge. Defaults to true, the tunnel CNAME only
+	// resolves to something reachable when proxied.
+	// +optional
+	Proxied *bool `json:"proxied,omitempty"`
+
+	// TTL of the record in seconds, 1 for automatic. Proxied records are always automatic.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=86400
+	// +optional
+	TTL int `json:"ttl,omitempty"`
+
+	// Comment on the record. Left alone if not set.
+	// +kubebuilder:validation:MaxLength=100
+	// +optional
+	Comment string `json:"comment,omitempty"`
+
+	// Tags on the record, as name:value. Left alone if not set.
+	// +optional
+	Tags []string `json:"tags,omitempty"`
+}
+
+// Protocol is the kind of origin cloudflared sends traffic to.
+// +kubebuilder:validation:Enum=http;https;tcp;ssh;rdp;unix;http_status;hello_world
+type Protocol string
+
+const (
+	ProtocolHTTP       Protocol = "http"
+	ProtocolHTTPS      Protocol = "https"
+	ProtocolTCP        Protocol = "tcp"
+	ProtocolSSH        Protocol = "ssh"
+	ProtocolRDP        Protocol = "rdp"
+	ProtocolUnix       Protocol = "unix"
+	ProtocolHTTPStatus Protocol = "http_status"
+	ProtocolHelloWorld Protocol = "hello_world"
+)
+
+// ArgonautDefaultBackend is the catch-all rule at the end of the cloudflared config.
+type ArgonautDefaultBackend struct {
+	// Service to send unmatched requests to.
+	// +optional
+	ServiceRef *ArgonautServiceRef `json:"serviceRef,omitempty"`
+
+	// Protocol cloudflared speaks to the origin, like on an ingress rule.
+	// +optional
+	Protocol Protocol `json:"protocol,omitempty"`
+
+	// Path of the socket for protocol unix.
+	// +optional
+	UnixSocket string `json:"unixSocket,omitempty"`
+
+	// Status code to answer with for protocol http_status, which is implied when neither
+	// serviceRef nor protocol is set. Defaults to 404.
+	// +kubebuilder:validation:Minimum=100
+	// +kubebuilder:validation:Maximum=599
+	// +optional
+	StatusCode int `json:"statusCode,omitempty"`
+
+	// How cloudflared connects to the origin.
+	// +optional
+	OriginRequest *OriginRequest `json:"originRequest,omitempty"`
+}
+
+// Rule returns the default backend as an ingress rule without hostname. Without a serviceRef or
+// protocol it answers with the status code.
+func (b *ArgonautDefaultBackend) Rule() ArgonautIngressRule {
+	protocol := b.Protocol
+	if b.ServiceRef == nil && len(protocol) == 0 {
+		protocol = ProtocolHTTPStatus
+	}
+	return ArgonautIngressRule{
+		ServiceRef:    b.ServiceRef,
+		Protocol:      protocol,
+		UnixSocket:    b.UnixSocket,
+		StatusCode:    b.StatusCode,
+		OriginRequest: b.OriginRequest,
+	}
+}
+
+// ArgonautServiceRef points an ingress rule at a single Service.
+type ArgonautServiceRef struct {
+	Name string `json:"name"`
+
+	// Namespace of the Service, defaults to the namespace of the Argonaut. Other namespaces need
+	// a ServiceGrant allowing this namespace.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// Port of the Service, by name or number. May be left out if the Service has a single port.
+	// +optional
+	Port *intstr.IntOrString `json:"port,omitempty"`
 }
 
 // ArgonautStatus defines the observed state of Argonaut
 type ArgonautStatus struct {
 
-	// Hold UUID for Argo Tunnel. Gets populated when reconciled or created.
+	// Generation of the Argonaut last reconciled.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions of the Argonaut: TunnelReady, ConfigReady, DeploymentAvailable, DNSReady and
+	// Ready, which is only True when all the others are.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	TunnelStatus `json:",inline"`
+
+	// Name of the shared ArgoTunnel this Argonaut contributes ingress rules to. Empty when the
+	// Argonaut runs its own tunnel.
+	ArgoTunnel string `json:"argoTunnel,omitempty"`
+
+	// Hostnames of the Argonaut, where their DNS records point or why they are not published.
+	// +optional
+	Hostnames []ArgonautHostnameStatus `json:"hostnames,omitempty"`
+
+	// Backend services each ingress rule resolved to.
+	// +optional
+	Rules []ArgonautRuleStatus `json:"rules,omitempty"`
+}
+
+// ArgonautHostnameStatus is a hostname of the Argonaut and whether it is published in DNS.
+type ArgonautHostnameStatus struct {
+	Hostname string `json:"hostname"`
+
+	// Cloudflare zone the hostname belongs to.
+	// +optional
+	Zone string `json:"zone,omitempty"`
+
+	// CNAME target of the DNS record. Empty when the hostname is not published.
+	// +optional
+	Target string `json:"target,omitempty"`
+
+	// Why the hostname is not published, in a single CamelCase word.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+
+	// Why the hostname is not published, for humans.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// ArgonautRuleStatus is an ingress rule along with the services it routes to.
+type ArgonautRuleStatus struct {
+	Hostname string `json:"hostname"`
+
+	// +optional
+	Path string `json:"path,omitempty"`
+
+	// Services the rule routes to, as written to the cloudflared config.
+	// +optional
+	Services []string `json:"services,omitempty"`
+
+	// Services selected in other namespaces that no ServiceGrant allows, as namespace/name.
+	// +optional
+	Denied []string `json:"denied,omitempty"`
+
+	// Why the rule did not resolve to exactly one backend, if so.
+	// +optional
+	Warning string `json:"warning,omitempty"`
+}
+
+// Condition types used on Argonaut and ArgoTunnel.
+const (
+	// The Argo Tunnel exists and cloudflared has credentials for it.
+	ConditionTunnelReady = "TunnelReady"
+
+	// The cloudflared config holds the ingress rules.
+	ConditionConfigReady = "ConfigReady"
+
+	// The cloudflared Deployment has available replicas.
+	ConditionDeploymentAvailable = "DeploymentAvailable"
+
+	// DNS records for all hostnames point at the tunnel. Not used on ArgoTunnel.
+	ConditionDNSReady = "DNSReady"
+
+	// All of the above are True.
+	ConditionReady = "Ready"
+)
+
+// TunnelStatus is the observed state of an Argo Tunnel, shared by Argonaut and ArgoTunnel.
+type TunnelStatus struct {
+
+	// Hold UUID for Argo Tunnel. Gets populated when reconciled or created. This is the
+	// tunnel DNS records point at.
 	TunnelId string `json:"tunnelId,omitempty"`
+
+	// UUID of the tunnel being replaced after a rotation. Deleted once cloudflared runs the
+	// new tunnel everywhere and DNS has moved over.
+	PreviousTunnelId string `json:"previousTunnelId,omitempty"`
+
+	// Value of the argonaut.metalabs.no/rotate-tunnel-secret annotation last acted upon.
+	TunnelSecretRotation string `json:"tunnelSecretRotation,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Tunnel",type=string,JSONPath=`.spec.argoTunnelName`
+//+kubebuilder:printcolumn:name="Tunnel ID",type=string,JSONPath=`.status.tunnelId`,priority=1
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Reason",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].reason`
+//+kubebuilder:printcolumn:name="Message",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].message`,priority=1
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // Argonaut is the Schema for the argonauts API
 type Argonaut struct {
@@ -0,0 +1,236 @@
+/*
+Copyright 2021 The Argonaut authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"context"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"reflect"
+	"regexp"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// log is for logging in this package.
+var argonautlog = logf.Log.WithName("argonaut-resource")
+
+// Looks up the ArgoTunnel an Argonaut names, set along with the webhook.
+var webhookClient client.Reader
+
+func (r *Argonaut) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	webhookClient = mgr.GetClient()
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/validate-argonaut-metalabs-no-v1beta1-argonaut,mutating=false,failurePolicy=fail,sideEffects=None,groups=argonaut.metalabs.no,resources=argonauts,verbs=create;update,versions=v1beta1,name=vargonaut.kb.io,admissionReviewVersions={v1,v1beta1}
+
+var _ webhook.Validator = &Argonaut{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *Argonaut) ValidateCreate() error {
+	argonautlog.Info("validate create", "name", r.Name)
+	return r.validateArgonaut()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *Argonaut) ValidateUpdate(old runtime.Object) error {
+	argonautlog.Info("validate update", "name", r.Name)
+	if r.DeletionTimestamp != nil {
+		// Removing the finalizer must go through even if the spec no longer validates.
+		return nil
+	}
+	return r.validateArgonaut()
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *Argonaut) ValidateDelete() error {
+	return nil
+}
+
+func (r *Argonaut) validateArgonaut() error {
+	var allErrs field.ErrorList
+	allErrs = append(allErrs, validateOriginRequest(r.Spec.OriginRequest, field.NewPath("spec", "originRequest"))...)
+	dns := make(map[string]*ArgonautDNSOptions)
+	for i, rule := range r.Spec.Ingress {
+		path := field.NewPath("spec", "ingress").Index(i)
+		allErrs = append(allErrs, validateIngressRule(&rule, path)...)
+		allErrs = append(allErrs, validateRuleBackend(&rule, path)...)
+		if rule.DNS == nil {
+			continue
+		}
+		if len(rule.Hostname) == 0 {
+			allErrs = append(allErrs, field.Forbidden(path.Child("dns"), "requires a hostname"))
+		} else if other, ok := dns[rule.Hostname]; ok && !reflect.DeepEqual(other, rule.DNS) {
+			allErrs = append(allErrs, field.Invalid(path.Child("dns"), "", "differs from an earlier rule for "+rule.Hostname))
+		} else {
+			dns[rule.Hostname] = rule.DNS
+		}
+	}
+	allErrs = append(allErrs, validateDefaultBackend(r.Spec.DefaultBackend, field.NewPath("spec", "defaultBackend"))...)
+	allErrs = append(allErrs, validateDeployment(r.Spec.Deployment, field.NewPath("spec", "deployment"))...)
+	allErrs = append(allErrs, r.validateSharedTunnel()...)
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("Argonaut").GroupKind(), r.Name, allErrs)
+}
+
+// Forbids caPool on an Argonaut sharing an ArgoTunnel. cloudflared runs in the namespace of the
+// ArgoTunnel, where the Argonaut has no say over what is mounted.
+func (r *Argonaut) validateSharedTunnel() field.ErrorList {
+	if webhookClient == nil || len(r.Spec.ArgoTunnelName) == 0 {
+		return nil
+	}
+	var tunnel ArgoTunnel
+	if err := webhookClient.Get(context.Background(), client.ObjectKey{Name: r.Spec.ArgoTunnelName}, &tunnel); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return field.ErrorList{field.InternalError(field.NewPath("spec", "argoTunnelName"), err)}
+	}
+	return sharedCAPools(r, tunnel.Name)
+}
+
+// The caPool fields of an Argonaut, as forbidden on an ArgoTunnel it shares.
+func sharedCAPools(r *Argonaut, tunnel string) field.ErrorList {
+	var allErrs field.ErrorList
+	detail := fmt.Sprintf("not allowed on an Argonaut sharing ArgoTunnel %s", tunnel)
+	if o := r.Spec.OriginRequest; o != nil && o.CAPool != nil {
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "originRequest", "caPool"), detail))
+	}
+	for i, rule := range r.Spec.Ingress {
+		if o := rule.OriginRequest; o != nil && o.CAPool != nil {
+			allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "ingress").Index(i).Child("originRequest", "caPool"), detail))
+		}
+	}
+	return allErrs
+}
+
+// Checks the parts of an ingress rule the CRD schema can't: that it has a single kind of backend
+// and a path cloudflared can compile.
+func validateIngressRule(rule *ArgonautIngressRule, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	var backends []string
+	if selectorSet(rule.ServiceSelector) {
+		backends = append(backends, "serviceSelector")
+	}
+	if selectorSet(rule.EndpointsSelector) {
+		backends = append(backends, "endpointsSelector")
+	}
+	if rule.ServiceRef != nil {
+		backends = append(backends, "serviceRef")
+	}
+	if len(backends) > 1 {
+		allErrs = append(allErrs, field.Forbidden(path.Child(backends[1]), "may not be combined with "+backends[0]))
+	}
+
+	switch rule.Protocol {
+	case ProtocolUnix:
+		if len(rule.UnixSocket) == 0 {
+			allErrs = append(allErrs, field.Required(path.Child("unixSocket"), "required for protocol unix"))
+		}
+		fallthrough
+	case ProtocolHTTPStatus, ProtocolHelloWorld:
+		if len(backends) != 0 {
+			allErrs = append(allErrs, field.Forbidden(path.Child(backends[0]), "not used with protocol "+string(rule.Protocol)))
+		}
+	}
+
+	if _, err := regexp.Compile(rule.Path); err != nil {
+		allErrs = append(allErrs, field.Invalid(path.Child("path"), rule.Path, err.Error()))
+	}
+	return append(allErrs, validateOriginRequest(rule.OriginRequest, path.Child("originRequest"))...)
+}
+
+// Checks that an ingress rule has a backend, unless its protocol needs none. Without one the rule
+// would select every Service in the namespace.
+func validateRuleBackend(rule *ArgonautIngressRule, path *field.Path) field.ErrorList {
+	switch rule.Protocol {
+	case ProtocolHTTPStatus, ProtocolHelloWorld, ProtocolUnix:
+		return nil
+	}
+	if rule.ServiceRef != nil || selectorSet(rule.ServiceSelector) || selectorSet(rule.EndpointsSelector) {
+		return nil
+	}
+	return field.ErrorList{field.Required(path.Child("serviceRef"), "one of serviceRef, serviceSelector or endpointsSelector is required unless protocol is http_status, hello_world or unix")}
+}
+
+// Checks if a label selector of a rule selects anything at all.
+func selectorSet(selector metav1.LabelSelector) bool {
+	return len(selector.MatchLabels) != 0 || len(selector.MatchExpressions) != 0
+}
+
+// Checks a default backend like an ingress rule. Only a serviceRef can give it an origin, it never
+// selects Services.
+func validateDefaultBackend(b *ArgonautDefaultBackend, path *field.Path) field.ErrorList {
+	if b == nil {
+		return nil
+	}
+	rule := b.Rule()
+	allErrs := validateIngressRule(&rule, path)
+	switch rule.Protocol {
+	case ProtocolHTTPStatus, ProtocolHelloWorld, ProtocolUnix:
+	default:
+		if rule.ServiceRef == nil {
+			allErrs = append(allErrs, field.Required(path.Child("serviceRef"), "required for protocol "+string(rule.Protocol)))
+		}
+	}
+	return allErrs
+}
+
+func validateOriginRequest(o *OriginRequest, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if o == nil || o.CAPool == nil {
+		return allErrs
+	}
+	if (o.CAPool.ConfigMapKeyRef == nil) == (o.CAPool.SecretKeyRef == nil) {
+		allErrs = append(allErrs, field.Invalid(path.Child("caPool"), "", "exactly one of configMapKeyRef and secretKeyRef must be set"))
+	}
+	return allErrs
+}
+
+func validateDeployment(d *CloudflaredDeployment, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if d == nil {
+		return allErrs
+	}
+	if b := d.DisruptionBudget; b != nil && b.MinAvailable != nil && b.MaxUnavailable != nil {
+		allErrs = append(allErrs, field.Forbidden(path.Child("disruptionBudget", "maxUnavailable"), "may not be combined with minAvailable"))
+	}
+	if a := d.Autoscaling; a != nil && a.MinReplicas != nil && *a.MinReplicas > a.MaxReplicas {
+		allErrs = append(allErrs, field.Invalid(path.Child("autoscaling", "minReplicas"), *a.MinReplicas, "must not exceed maxReplicas"))
+	}
+	if a := d.Autoscaling; a != nil && (a.TargetCPUUtilizationPercentage != nil || a.TargetRequestsPerSecond == nil) && len(d.Resources.Requests) != 0 {
+		// Without requests the operator sets its own, with some there must be one for CPU.
+		_, requested := d.Resources.Requests[v1.ResourceCPU]
+		_, limited := d.Resources.Limits[v1.ResourceCPU]
+		if !requested && !limited {
+			allErrs = append(allErrs, field.Required(path.Child("resources", "requests", "cpu"), "autoscaling on CPU utilization needs a CPU request"))
+		}
+	}
+	return allErrs
+}
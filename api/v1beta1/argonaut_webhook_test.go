@@ -0,0 +1,349 @@
+/*
+Copyright 2021 The Argonaut authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"reflect"
+	"testing"
+)
+
+// Fields the validation error of an object points at, nil if it is valid.
+func invalidFields(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	status, ok := err.(*apierrors.StatusError)
+	if !ok || status.ErrStatus.Details == nil {
+		t.Fatalf("expected an Invalid error, got %v", err)
+	}
+	var fields []string
+	for _, cause := range status.ErrStatus.Details.Causes {
+		fields = append(fields, cause.Field)
+	}
+	return fields
+}
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+func intOrStringPtr(v intstr.IntOrString) *intstr.IntOrString {
+	return &v
+}
+
+var (
+	webRef   = &ArgonautServiceRef{Name: "web"}
+	webLabel = metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}
+	caMap    = &CABundle{ConfigMapKeyRef: &v1.ConfigMapKeySelector{LocalObjectReference: v1.LocalObjectReference{Name: "ca"}, Key: "ca.crt"}}
+	caSecret = &CABundle{SecretKeyRef: &v1.SecretKeySelector{LocalObjectReference: v1.LocalObjectReference{Name: "ca"}, Key: "ca.crt"}}
+)
+
+func TestValidateArgonaut(t *testing.T) {
+	tests := []struct {
+		name   string
+		spec   ArgonautSpec
+		fields []string
+	}{
+		{
+			name: "serviceRef",
+			spec: ArgonautSpec{Ingress: []ArgonautIngressRule{{Hostname: "a.example.com", ServiceRef: webRef}}},
+		},
+		{
+			name: "serviceSelector and endpointsSelector",
+			spec: ArgonautSpec{Ingress: []ArgonautIngressRule{
+				{Hostname: "a.example.com", ServiceSelector: webLabel, EndpointsSelector: webLabel},
+			}},
+			fields: []string{"spec.ingress[0].endpointsSelector"},
+		},
+		{
+			name: "serviceSelector and serviceRef",
+			spec: ArgonautSpec{Ingress: []ArgonautIngressRule{
+				{Hostname: "a.example.com", ServiceSelector: webLabel, ServiceRef: webRef},
+			}},
+			fields: []string{"spec.ingress[0].serviceRef"},
+		},
+		{
+			name:   "no backend",
+			spec:   ArgonautSpec{Ingress: []ArgonautIngressRule{{Hostname: "a.example.com"}}},
+			fields: []string{"spec.ingress[0].serviceRef"},
+		},
+		{
+			name: "http_status without backend",
+			spec: ArgonautSpec{Ingress: []ArgonautIngressRule{{Hostname: "a.example.com", Protocol: ProtocolHTTPStatus}}},
+		},
+		{
+			name: "hello_world with backend",
+			spec: ArgonautSpec{Ingress: []ArgonautIngressRule{
+				{Hostname: "a.example.com", Protocol: ProtocolHelloWorld, ServiceRef: webRef},
+			}},
+			fields: []string{"spec.ingress[0].serviceRef"},
+		},
+		{
+			name:   "unix without socket",
+			spec:   ArgonautSpec{Ingress: []ArgonautIngressRule{{Hostname: "a.example.com", Protocol: ProtocolUnix}}},
+			fields: []string{"spec.ingress[0].unixSocket"},
+		},
+		{
+			name: "unix with socket",
+			spec: ArgonautSpec{Ingress: []ArgonautIngressRule{
+				{Hostname: "a.example.com", Protocol: ProtocolUnix, UnixSocket: "/run/app.sock"},
+			}},
+		},
+		{
+			name: "https with serviceRef",
+			spec: ArgonautSpec{Ingress: []ArgonautIngressRule{
+				{Hostname: "a.example.com", Protocol: ProtocolHTTPS, ServiceRef: webRef},
+			}},
+		},
+		{
+			name: "bad path",
+			spec: ArgonautSpec{Ingress: []ArgonautIngressRule{
+				{Hostname: "a.example.com", Path: "/api/(v1", ServiceRef: webRef},
+			}},
+			fields: []string{"spec.ingress[0].path"},
+		},
+		{
+			name: "regex path",
+			spec: ArgonautSpec{Ingress: []ArgonautIngressRule{
+				{Hostname: "a.example.com", Path: `^/api/v[0-9]+/.*\.json$`, ServiceRef: webRef},
+			}},
+		},
+		{
+			name: "caPool from a ConfigMap",
+			spec: ArgonautSpec{Ingress: []ArgonautIngressRule{
+				{Hostname: "a.example.com", ServiceRef: webRef, OriginRequest: &OriginRequest{CAPool: caMap}},
+			}},
+		},
+		{
+			name: "caPool from a ConfigMap and a Secret",
+			spec: ArgonautSpec{Ingress: []ArgonautIngressRule{
+				{Hostname: "a.example.com", ServiceRef: webRef, OriginRequest: &OriginRequest{CAPool: &CABundle{
+					ConfigMapKeyRef: caMap.ConfigMapKeyRef,
+					SecretKeyRef:    caSecret.SecretKeyRef,
+				}}},
+			}},
+			fields: []string{"spec.ingress[0].originRequest.caPool"},
+		},
+		{
+			name: "empty caPool",
+			spec: ArgonautSpec{
+				OriginRequest: &OriginRequest{CAPool: &CABundle{}},
+				Ingress:       []ArgonautIngressRule{{Hostname: "a.example.com", ServiceRef: webRef}},
+			},
+			fields: []string{"spec.originRequest.caPool"},
+		},
+		{
+			name: "same DNS options per hostname",
+			spec: ArgonautSpec{Ingress: []ArgonautIngressRule{
+				{Hostname: "a.example.com", Path: "/api", ServiceRef: webRef, DNS: &ArgonautDNSOptions{TTL: 300}},
+				{Hostname: "a.example.com", ServiceRef: webRef, DNS: &ArgonautDNSOptions{TTL: 300}},
+			}},
+		},
+		{
+			name: "DNS options on one rule of a hostname",
+			spec: ArgonautSpec{Ingress: []ArgonautIngressRule{
+				{Hostname: "a.example.com", Path: "/api", ServiceRef: webRef, DNS: &ArgonautDNSOptions{TTL: 300}},
+				{Hostname: "a.example.com", ServiceRef: webRef},
+			}},
+		},
+		{
+			name: "conflicting DNS options",
+			spec: ArgonautSpec{Ingress: []ArgonautIngressRule{
+				{Hostname: "a.example.com", Path: "/api", ServiceRef: webRef, DNS: &ArgonautDNSOptions{TTL: 300}},
+				{Hostname: "b.example.com", ServiceRef: webRef, DNS: &ArgonautDNSOptions{TTL: 60}},
+				{Hostname: "a.example.com", ServiceRef: webRef, DNS: &ArgonautDNSOptions{Comment: "web"}},
+			}},
+			fields: []string{"spec.ingress[2].dns"},
+		},
+		{
+			name: "DNS options without hostname",
+			spec: ArgonautSpec{Ingress: []ArgonautIngressRule{
+				{ServiceRef: webRef, DNS: &ArgonautDNSOptions{TTL: 300}},
+			}},
+			fields: []string{"spec.ingress[0].dns"},
+		},
+		{
+			name:   "default backend without serviceRef",
+			spec:   ArgonautSpec{DefaultBackend: &ArgonautDefaultBackend{Protocol: ProtocolHTTPS}},
+			fields: []string{"spec.defaultBackend.serviceRef"},
+		},
+		{
+			name: "default backend answering a status",
+			spec: ArgonautSpec{DefaultBackend: &ArgonautDefaultBackend{Protocol: ProtocolHTTPStatus}},
+		},
+		{
+			name: "default backend with bad caPool",
+			spec: ArgonautSpec{DefaultBackend: &ArgonautDefaultBackend{
+				ServiceRef:    webRef,
+				OriginRequest: &OriginRequest{CAPool: &CABundle{}},
+			}},
+			fields: []string{"spec.defaultBackend.originRequest.caPool"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			argonaut := &Argonaut{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "test"}, Spec: tt.spec}
+			if fields := invalidFields(t, argonaut.ValidateCreate()); !reflect.DeepEqual(fields, tt.fields) {
+				t.Errorf("invalid fields %v, want %v", fields, tt.fields)
+			}
+		})
+	}
+}
+
+func TestValidateDeployment(t *testing.T) {
+	tests := []struct {
+		name       string
+		deployment *CloudflaredDeployment
+		fields     []string
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name: "minAvailable",
+			deployment: &CloudflaredDeployment{DisruptionBudget: &CloudflaredDisruptionBudget{
+				MinAvailable: intOrStringPtr(intstr.FromInt(1)),
+			}},
+		},
+		{
+			name: "minAvailable and maxUnavailable",
+			deployment: &CloudflaredDeployment{DisruptionBudget: &CloudflaredDisruptionBudget{
+				MinAvailable:   intOrStringPtr(intstr.FromInt(1)),
+				MaxUnavailable: intOrStringPtr(intstr.FromString("50%")),
+			}},
+			fields: []string{"spec.deployment.disruptionBudget.maxUnavailable"},
+		},
+		{
+			name: "minReplicas above maxReplicas",
+			deployment: &CloudflaredDeployment{Autoscaling: &CloudflaredAutoscaling{
+				MinReplicas: int32Ptr(5),
+				MaxReplicas: 3,
+			}},
+			fields: []string{"spec.deployment.autoscaling.minReplicas"},
+		},
+		{
+			name: "minReplicas at maxReplicas",
+			deployment: &CloudflaredDeployment{Autoscaling: &CloudflaredAutoscaling{
+				MinReplicas: int32Ptr(3),
+				MaxReplicas: 3,
+			}},
+		},
+		{
+			name: "CPU autoscaling with memory request only",
+			deployment: &CloudflaredDeployment{
+				Autoscaling: &CloudflaredAutoscaling{MaxReplicas: 3},
+				Resources: v1.ResourceRequirements{Requests: v1.ResourceList{
+					v1.ResourceMemory: resource.MustParse("64Mi"),
+				}},
+			},
+			fields: []string{"spec.deployment.resources.requests.cpu"},
+		},
+		{
+			name: "CPU autoscaling with CPU limit",
+			deployment: &CloudflaredDeployment{
+				Autoscaling: &CloudflaredAutoscaling{MaxReplicas: 3},
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{v1.ResourceMemory: resource.MustParse("64Mi")},
+					Limits:   v1.ResourceList{v1.ResourceCPU: resource.MustParse("500m")},
+				},
+			},
+		},
+		{
+			name: "request rate autoscaling with memory request only",
+			deployment: &CloudflaredDeployment{
+				Autoscaling: &CloudflaredAutoscaling{MaxReplicas: 3, TargetRequestsPerSecond: resource.NewQuantity(100, resource.DecimalSI)},
+				Resources: v1.ResourceRequirements{Requests: v1.ResourceList{
+					v1.ResourceMemory: resource.MustParse("64Mi"),
+				}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			argonaut := &Argonaut{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "test"}, Spec: ArgonautSpec{Deployment: tt.deployment}}
+			if fields := invalidFields(t, argonaut.ValidateCreate()); !reflect.DeepEqual(fields, tt.fields) {
+				t.Errorf("Argonaut: invalid fields %v, want %v", fields, tt.fields)
+			}
+			tunnel := &ArgoTunnel{ObjectMeta: metav1.ObjectMeta{Name: "test"}, Spec: ArgoTunnelSpec{Deployment: tt.deployment}}
+			if fields := invalidFields(t, tunnel.ValidateCreate()); !reflect.DeepEqual(fields, tt.fields) {
+				t.Errorf("ArgoTunnel: invalid fields %v, want %v", fields, tt.fields)
+			}
+		})
+	}
+}
+
+func TestValidateArgoTunnel(t *testing.T) {
+	tests := []struct {
+		name   string
+		spec   ArgoTunnelSpec
+		fields []string
+	}{
+		{
+			name: "default backend with serviceRef",
+			spec: ArgoTunnelSpec{DefaultBackend: &ArgonautDefaultBackend{ServiceRef: webRef, OriginRequest: &OriginRequest{CAPool: caSecret}}},
+		},
+		{
+			name: "empty default backend",
+			spec: ArgoTunnelSpec{DefaultBackend: &ArgonautDefaultBackend{}},
+		},
+		{
+			name:   "default backend with protocol but no serviceRef",
+			spec:   ArgoTunnelSpec{DefaultBackend: &ArgonautDefaultBackend{Protocol: ProtocolTCP}},
+			fields: []string{"spec.defaultBackend.serviceRef"},
+		},
+		{
+			name: "default backend with bad caPool",
+			spec: ArgoTunnelSpec{DefaultBackend: &ArgonautDefaultBackend{
+				ServiceRef:    webRef,
+				OriginRequest: &OriginRequest{CAPool: &CABundle{}},
+			}},
+			fields: []string{"spec.defaultBackend.originRequest.caPool"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnel := &ArgoTunnel{ObjectMeta: metav1.ObjectMeta{Name: "test"}, Spec: tt.spec}
+			if fields := invalidFields(t, tunnel.ValidateCreate()); !reflect.DeepEqual(fields, tt.fields) {
+				t.Errorf("invalid fields %v, want %v", fields, tt.fields)
+			}
+		})
+	}
+}
+
+func TestSharedCAPools(t *testing.T) {
+	argonaut := &Argonaut{Spec: ArgonautSpec{
+		OriginRequest: &OriginRequest{CAPool: caMap},
+		Ingress: []ArgonautIngressRule{
+			{Hostname: "a.example.com", ServiceRef: webRef},
+			{Hostname: "b.example.com", ServiceRef: webRef, OriginRequest: &OriginRequest{CAPool: caSecret}},
+		},
+	}}
+	var fields []string
+	for _, err := range sharedCAPools(argonaut, "shared") {
+		fields = append(fields, err.Field)
+	}
+	want := []string{"spec.originRequest.caPool", "spec.ingress[1].originRequest.caPool"}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("forbidden fields %v, want %v", fields, want)
+	}
+}
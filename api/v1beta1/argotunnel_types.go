@@ -0,0 +1,117 @@
+/*
+Copyright 2021 The Argonaut authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ArgoTunnelSpec defines the desired state of ArgoTunnel
+type ArgoTunnelSpec struct {
+
+	// Name of the tunnel in Cloudflare. Defaults to the name of the ArgoTunnel.
+	// +optional
+	TunnelName string `json:"tunnelName,omitempty"`
+
+	// Namespace the cloudflared Deployment, its ConfigMap and the tunnel Secret live in.
+	Namespace string `json:"namespace"`
+
+	// Secret Reference containing credentials for an existing tunnel, see the argoTunnelSecret
+	// field of Argonaut. Must be in the namespace above.
+	// +optional
+	ArgoTunnelSecret v1.SecretReference `json:"argoTunnelSecret,omitempty"`
+
+	// Reference to a secret that contains email and token for CloudFlare API access.
+	CFAuthSecret v1.SecretReference `json:"cfAuthSecret"`
+
+	// What happens to the Argo Tunnel when this ArgoTunnel is deleted. DNS records of the
+	// Argonauts using it are removed along with the tunnel unless this is Orphan.
+	// +kubebuilder:default=Delete
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// Where requests go that no ingress rule of the attached Argonauts matches. Answers 404 if
+	// not set. A serviceRef defaults to the namespace cloudflared runs in.
+	// +optional
+	DefaultBackend *ArgonautDefaultBackend `json:"defaultBackend,omitempty"`
+
+	// Settings for the cloudflared Deployment.
+	// +optional
+	Deployment *CloudflaredDeployment `json:"deployment,omitempty"`
+}
+
+// ArgoTunnelStatus defines the observed state of ArgoTunnel
+type ArgoTunnelStatus struct {
+
+	// Generation of the ArgoTunnel last reconciled.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions of the ArgoTunnel: TunnelReady, ConfigReady, DeploymentAvailable and Ready.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	TunnelStatus `json:",inline"`
+
+	// Argonauts contributing ingress rules to this tunnel.
+	Argonauts []ArgoTunnelArgonaut `json:"argonauts,omitempty"`
+}
+
+// ArgoTunnelArgonaut is an Argonaut whose ingress rules are merged into an ArgoTunnel.
+type ArgoTunnelArgonaut struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+
+	// Hostnames the Argonaut routes through the tunnel. Hostnames another Argonaut on the
+	// tunnel serves are left out.
+	Hostnames []string `json:"hostnames,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Namespace",type=string,JSONPath=`.spec.namespace`
+//+kubebuilder:printcolumn:name="Tunnel ID",type=string,JSONPath=`.status.tunnelId`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Reason",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].reason`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// ArgoTunnel is the Schema for the argotunnels API. It runs an Argo Tunnel shared by every
+// Argonaut with a matching argoTunnelName.
+type ArgoTunnel struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ArgoTunnelSpec   `json:"spec,omitempty"`
+	Status ArgoTunnelStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ArgoTunnelList contains a list of ArgoTunnel
+type ArgoTunnelList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ArgoTunnel `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ArgoTunnel{}, &ArgoTunnelList{})
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2021 The Argonaut authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// log is for logging in this package.
+var argotunnellog = logf.Log.WithName("argotunnel-resource")
+
+func (r *ArgoTunnel) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/validate-argonaut-metalabs-no-v1beta1-argotunnel,mutating=false,failurePolicy=fail,sideEffects=None,groups=argonaut.metalabs.no,resources=argotunnels,verbs=create;update,versions=v1beta1,name=vargotunnel.kb.io,admissionReviewVersions={v1,v1beta1}
+
+var _ webhook.Validator = &ArgoTunnel{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *ArgoTunnel) ValidateCreate() error {
+	argotunnellog.Info("validate create", "name", r.Name)
+	return r.validateArgoTunnel()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *ArgoTunnel) ValidateUpdate(old runtime.Object) error {
+	argotunnellog.Info("validate update", "name", r.Name)
+	if r.DeletionTimestamp != nil {
+		// Removing the finalizer must go through even if the spec no longer validates.
+		return nil
+	}
+	return r.validateArgoTunnel()
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *ArgoTunnel) ValidateDelete() error {
+	return nil
+}
+
+// Checks the default backend and deployment settings the same way as those of an Argonaut.
+func (r *ArgoTunnel) validateArgoTunnel() error {
+	var allErrs field.ErrorList
+	allErrs = append(allErrs, validateDefaultBackend(r.Spec.DefaultBackend, field.NewPath("spec", "defaultBackend"))...)
+	allErrs = append(allErrs, validateDeployment(r.Spec.Deployment, field.NewPath("spec", "deployment"))...)
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("ArgoTunnel").GroupKind(), r.Name, allErrs)
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2021 The Argonaut authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// CloudflaredDeployment tunes the cloudflared Deployment running a tunnel.
+type CloudflaredDeployment struct {
+
+	// Number of cloudflared pods. Defaults to 1, left alone after creation if not set so
+	// something else may scale the Deployment.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// cloudflared image. Defaults to the image the operator is started with.
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// Tag of the cloudflared image, replacing the tag or digest of image or the default image.
+	// +optional
+	Tag string `json:"tag,omitempty"`
+
+	// +optional
+	ImagePullPolicy v1.PullPolicy `json:"imagePullPolicy,omitempty"`
+
+	// +optional
+	ImagePullSecrets []v1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+
+	// Compute resources of the cloudflared container.
+	// +optional
+	Resources v1.ResourceRequirements `json:"resources,omitempty"`
+
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// +optional
+	Tolerations []v1.Toleration `json:"tolerations,omitempty"`
+
+	// Defaults to spreading pods across nodes and zones when running more than one.
+	// +optional
+	Affinity *v1.Affinity `json:"affinity,omitempty"`
+
+	// +optional
+	TopologySpreadConstraints []v1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+
+	// +optional
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+
+	// Extra labels for the Deployment and its pods. The label selecting the pods can't be
+	// overridden.
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Extra annotations for the pods.
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Extra environment variables for cloudflared.
+	// +optional
+	Env []v1.EnvVar `json:"env,omitempty"`
+
+	// Extra arguments to cloudflared tunnel, placed before the run command.
+	// +optional
+	Args []string `json:"args,omitempty"`
+
+	// PodDisruptionBudget for tunnels running more than one pod. Defaults to one pod unavailable
+	// at a time.
+	// +optional
+	DisruptionBudget *CloudflaredDisruptionBudget `json:"disruptionBudget,omitempty"`
+
+	// Scales cloudflared with a HorizontalPodAutoscaler. replicas is not used when set.
+	// +optional
+	Autoscaling *CloudflaredAutoscaling `json:"autoscaling,omitempty"`
+}
+
+// CloudflaredDisruptionBudget sets either minAvailable or maxUnavailable of the
+// PodDisruptionBudget.
+type CloudflaredDisruptionBudget struct {
+	// +optional
+	MinAvailable *intstr.IntOrString `json:"minAvailable,omitempty"`
+
+	// +optional
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+}
+
+// CloudflaredAutoscaling configures the HorizontalPodAutoscaler of a cloudflared Deployment.
+type CloudflaredAutoscaling struct {
+	// Defaults to 2.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MinReplicas *int32 `json:"minReplicas,omitempty"`
+
+	// +kubebuilder:validation:Minimum=1
+	MaxReplicas int32 `json:"maxReplicas"`
+
+	// Average CPU utilization to scale at, in percent of the requested CPU. Defaults to 80 unless
+	// targetRequestsPerSecond is set.
+	// +optional
+	TargetCPUUtilizationPercentage *int32 `json:"targetCPUUtilizationPercentage,omitempty"`
+
+	// Average requests per second per pod to scale at. Needs the requestsMetric served through
+	// the custom metrics API, for example by prometheus-adapter.
+	// +optional
+	TargetRequestsPerSecond *resource.Quantity `json:"targetRequestsPerSecond,omitempty"`
+
+	// Pods metric holding the request rate of cloudflared. Defaults to
+	// cloudflared_tunnel_requests_per_second.
+	// +optional
+	RequestsMetric string `json:"requestsMetric,omitempty"`
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2021 The Argonaut authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// OriginRequest configures how cloudflared connects to an origin, see the originRequest section
+// of the cloudflared config. Fields left out fall back to the cloudflared defaults.
+type OriginRequest struct {
+
+	// Timeout for establishing a new connection to the origin.
+	// +optional
+	ConnectTimeout *metav1.Duration `json:"connectTimeout,omitempty"`
+
+	// Skip verifying the certificate of the origin.
+	// +optional
+	NoTLSVerify *bool `json:"noTLSVerify,omitempty"`
+
+	// Hostname expected in the certificate of the origin.
+	// +optional
+	OriginServerName string `json:"originServerName,omitempty"`
+
+	// CA bundle to verify the certificate of the origin with. Mounted into cloudflared, so it must
+	// live in the namespace cloudflared runs in.
+	// +optional
+	CAPool *CABundle `json:"caPool,omitempty"`
+
+	// Host header sent to the origin.
+	// +optional
+	HTTPHostHeader string `json:"httpHostHeader,omitempty"`
+
+	// Maximum number of idle keepalive connections to the origin.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	KeepAliveConnections *int `json:"keepAliveConnections,omitempty"`
+
+	// Disables chunked transfer encoding towards the origin.
+	// +optional
+	DisableChunkedEncoding *bool `json:"disableChunkedEncoding,omitempty"`
+
+	// Runs cloudflared as a proxy of this type instead of forwarding to the origin.
+	// +kubebuilder:validation:Enum=socks
+	// +optional
+	ProxyType string `json:"proxyType,omitempty"`
+
+	// Requires a valid Cloudflare Access JWT on requests.
+	// +optional
+	Access *OriginAccess `json:"access,omitempty"`
+}
+
+// CABundle refers to a PEM encoded CA bundle in a ConfigMap or a Secret.
+type CABundle struct {
+	// +optional
+	ConfigMapKeyRef *v1.ConfigMapKeySelector `json:"configMapKeyRef,omitempty"`
+
+	// +optional
+	SecretKeyRef *v1.SecretKeySelector `json:"secretKeyRef,omitempty"`
+}
+
+// OriginAccess configures Cloudflare Access JWT validation in cloudflared.
+type OriginAccess struct {
+	// Reject requests without a valid token.
+	// +optional
+	Required bool `json:"required,omitempty"`
+
+	// Cloudflare Zero Trust team the tokens are issued by.
+	TeamName string `json:"teamName"`
+
+	// Audience tags of the Access applications to accept.
+	// +optional
+	AudTag []string `json:"audTag,omitempty"`
+}
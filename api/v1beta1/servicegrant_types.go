@@ -0,0 +1,63 @@
+/*
+Copyright 2021 The Argonaut authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ServiceGrantSpec defines which Argonauts may route to Services in the namespace of the grant.
+type ServiceGrantSpec struct {
+
+	// Namespaces whose Argonauts may select Services in this namespace.
+	From []ServiceGrantFrom `json:"from"`
+
+	// Limits the grant to Services matching the selector. All Services in the namespace are
+	// granted if not set.
+	// +optional
+	ServiceSelector *metav1.LabelSelector `json:"serviceSelector,omitempty"`
+}
+
+// ServiceGrantFrom names a namespace allowed by a ServiceGrant.
+type ServiceGrantFrom struct {
+	Namespace string `json:"namespace"`
+}
+
+//+kubebuilder:object:root=true
+
+// ServiceGrant is the Schema for the servicegrants API. It lets Argonauts in other namespaces
+// route to Services in its own namespace through a namespaceSelector, much like a Gateway API
+// ReferenceGrant.
+type ServiceGrant struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ServiceGrantSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ServiceGrantList contains a list of ServiceGrant
+type ServiceGrantList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ServiceGrant `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ServiceGrant{}, &ServiceGrantList{})
+}
@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"context"
+	argonautv1 "github.com/laetho/argonaut/api/v1beta1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// Pods metric scaled on by targetRequestsPerSecond unless another is set.
+	defaultRequestsMetric = "cloudflared_tunnel_requests_per_second"
+)
+
+// Checks if a tunnel runs, or may be scaled to, more than one cloudflared pod.
+func highlyAvailable(settings *argonautv1.CloudflaredDeployment) bool {
+	if settings.Autoscaling != nil {
+		return settings.Autoscaling.MaxReplicas > 1
+	}
+	return settings.Replicas != nil && *settings.Replicas > 1
+}
+
+// Prefers spreading cloudflared pods over nodes, and then over zones.
+func defaultAntiAffinity(host *tunnelHost) *v1.Affinity {
+	term := func(weight int32, key string) v1.WeightedPodAffinityTerm {
+		return v1.WeightedPodAffinityTerm{
+			Weight: weight,
+			PodAffinityTerm: v1.PodAffinityTerm{
+				LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"argonaut": host.Name}},
+				TopologyKey:   key,
+			},
+		}
+	}
+	return &v1.Affinity{
+		PodAntiAffinity: &v1.PodAntiAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: []v1.WeightedPodAffinityTerm{
+				term(100, v1.LabelHostname),
+				term(50, v1.LabelTopologyZone),
+			},
+		},
+	}
+}
+
+// Creates, updates or removes the PodDisruptionBudget of a tunnel. Only tunnels running more than
+// one pod get one, a budget on a single pod would block node drains.
+func (r *ArgonautReconciler) ReconcilePodDisruptionBudget(ctx context.Context, host *tunnelHost, settings *argonautv1.CloudflaredDeployment) error {
+	if !highlyAvailable(settings) {
+		return r.deleteIfExists(ctx, &policyv1.PodDisruptionBudget{}, host.Name, host.Namespace)
+	}
+
+	maxUnavailable := intstr.FromInt(1)
+	desired := policyv1.PodDisruptionBudgetSpec{
+		Selector:       &metav1.LabelSelector{MatchLabels: map[string]string{"argonaut": host.Name}},
+		MaxUnavailable: &maxUnavailable,
+	}
+	if budget := settings.DisruptionBudget; budget != nil && (budget.MinAvailable != nil || budget.MaxUnavailable != nil) {
+		desired.MinAvailable = budget.MinAvailable
+		desired.MaxUnavailable = budget.MaxUnavailable
+	}
+
+	var pdb policyv1.PodDisruptionBudget
+	if err := r.Get(ctx, client.ObjectKey{Name: host.Name, Namespace: host.Namespace}, &pdb); err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		pdb.Name = host.Name
+		pdb.Namespace = host.Namespace
+		pdb.Labels = map[string]string{"argonaut": host.Name}
+		pdb.Spec = desired
+		if err := r.setHostOwner(host, &pdb); err != nil {
+			return err
+		}
+		if err := r.Create(ctx, &pdb); err != nil {
+			return err
+		}
+		log.FromContext(ctx).Info("Created PodDisruptionBudget", "name", pdb.Name)
+		return nil
+	}
+
+	if equality.Semantic.DeepEqual(desired, pdb.Spec) && metav1.IsControlledBy(&pdb, host.Owner) {
+		return nil
+	}
+	if err := r.setHostOwner(host, &pdb); err != nil {
+		return err
+	}
+	pdb.Spec = desired
+	if err := r.Update(ctx, &pdb); err != nil {
+		return err
+	}
+	log.FromContext(ctx).Info("Updated PodDisruptionBudget", "name", pdb.Name)
+	return nil
+}
+
+// Creates, updates or removes the HorizontalPodAutoscaler of a tunnel.
+func (r *ArgonautReconciler) ReconcileAutoscaler(ctx context.Context, host *tunnelHost, settings *argonautv1.CloudflaredDeployment) error {
+	scaling := settings.Autoscaling
+	if scaling == nil {
+		return r.deleteIfExists(ctx, &autoscalingv2.HorizontalPodAutoscaler{}, host.Name, host.Namespace)
+	}
+
+	desired := autoscalingv2.HorizontalPodAutoscalerSpec{
+		ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{
+			APIVersion: "apps/v1",
+			Kind:       "Deployment",
+			Name:       host.Name,
+		},
+		MinReplicas: autoscalerMinReplicas(scaling),
+		MaxReplicas: scaling.MaxReplicas,
+		Metrics:     autoscalerMetrics(scaling),
+	}
+
+	var hpa autoscalingv2.HorizontalPodAutoscaler
+	if err := r.Get(ctx, client.ObjectKey{Name: host.Name, Namespace: host.Namespace}, &hpa); err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		hpa.Name = host.Name
+		hpa.Namespace = host.Namespace
+		hpa.Labels = map[string]string{"argonaut": host.Name}
+		hpa.Spec = desired
+		if err := r.setHostOwner(host, &hpa); err != nil {
+			return err
+		}
+		if err := r.Create(ctx, &hpa); err != nil {
+			return err
+		}
+		log.FromContext(ctx).Info("Created HorizontalPodAutoscaler", "name", hpa.Name)
+		return nil
+	}
+
+	if equality.Semantic.DeepDerivative(desired, hpa.Spec) && metav1.IsControlledBy(&hpa, host.Owner) {
+		return nil
+	}
+	if err := r.setHostOwner(host, &hpa); err != nil {
+		return err
+	}
+	hpa.Spec = desired
+	if err := r.Update(ctx, &hpa); err != nil {
+		return err
+	}
+	log.FromContext(ctx).Info("Updated HorizontalPodAutoscaler", "name", hpa.Name)
+	return nil
+}
+
+func autoscalerMinReplicas(scaling *argonautv1.CloudflaredAutoscaling) *int32 {
+	if scaling.MinReplicas != nil {
+		return scaling.MinReplicas
+	}
+	min := int32(2)
+	if scaling.MaxReplicas < min {
+		min = scaling.MaxReplicas
+	}
+	return &min
+}
+
+// Metrics the autoscaler scales on: CPU, the request rate of cloudflared, or both.
+func autoscalerMetrics(scaling *argonautv1.CloudflaredAutoscaling) []autoscalingv2.MetricSpec {
+	var metrics []autoscalingv2.MetricSpec
+	cpu := scaling.TargetCPUUtilizationPercentage
+	if cpu == nil && scaling.TargetRequestsPerSecond == nil {
+		utilization := int32(80)
+		cpu = &utilization
+	}
+	if cpu != nil {
+		metrics = append(metrics, autoscalingv2.MetricSpec{
+			Type: autoscalingv2.ResourceMetricSourceType,
+			Resource: &autoscalingv2.ResourceMetricSource{
+				Name: v1.ResourceCPU,
+				Target: autoscalingv2.MetricTarget{
+					Type:               autoscalingv2.UtilizationMetricType,
+					AverageUtilization: cpu,
+				},
+			},
+		})
+	}
+	if scaling.TargetRequestsPerSecond != nil {
+		name := scaling.RequestsMetric
+		if len(name) == 0 {
+			name = defaultRequestsMetric
+		}
+		metrics = append(metrics, autoscalingv2.MetricSpec{
+			Type: autoscalingv2.PodsMetricSourceType,
+			Pods: &autoscalingv2.PodsMetricSource{
+				Metric: autoscalingv2.MetricIdentifier{Name: name},
+				Target: autoscalingv2.MetricTarget{
+					Type:         autoscalingv2.AverageValueMetricType,
+					AverageValue: scaling.TargetRequestsPerSecond,
+				},
+			},
+		})
+	}
+	return metrics
+}
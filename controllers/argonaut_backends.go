@@ -0,0 +1,344 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	argonautv1 "github.com/laetho/argonaut/api/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"regexp"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The origin an ingress rule resolved to.
+type ruleBackend struct {
+	// Origin service for the cloudflared config, empty if the rule resolved to nothing.
+	Service string
+
+	// Services left out for lack of a ServiceGrant, as namespace/name.
+	Denied []string
+
+	// Why the rule did not resolve to exactly one backend.
+	Warning string
+}
+
+// Resolve the origin service cloudflared should route an ingress rule to.
+func (r *ArgonautReconciler) ResolveIngressRule(ctx context.Context, argonaut *argonautv1.Argonaut, ingress argonautv1.ArgonautIngressRule) ruleBackend {
+	// cloudflared refuses to start on a path it can't compile, keep those out of the config.
+	if _, err := regexp.Compile(ingress.Path); err != nil {
+		return ruleBackend{Warning: fmt.Sprintf("path is not a valid regular expression: %v", err)}
+	}
+
+	switch ingress.Protocol {
+	case argonautv1.ProtocolHTTPStatus:
+		code := ingress.StatusCode
+		if code == 0 {
+			code = 404
+		}
+		return ruleBackend{Service: "http_status:" + strconv.Itoa(code)}
+	case argonautv1.ProtocolHelloWorld:
+		return ruleBackend{Service: "hello_world"}
+	case argonautv1.ProtocolUnix:
+		if len(ingress.UnixSocket) == 0 {
+			return ruleBackend{Warning: "protocol unix needs a unixSocket"}
+		}
+		return ruleBackend{Service: "unix:" + ingress.UnixSocket}
+	}
+	if ingress.ServiceRef != nil {
+		return r.resolveServiceRef(ctx, argonaut, ingress.ServiceRef, ingress.Protocol)
+	}
+	if selectorSet(ingress.EndpointsSelector) {
+		return r.resolveEndpoints(ctx, argonaut, ingress)
+	}
+	if !selectorSet(ingress.ServiceSelector) {
+		// An empty selector would pick whatever Service sorts first.
+		return ruleBackend{Warning: "rule has no backend, set serviceRef, serviceSelector, endpointsSelector or a protocol without origin"}
+	}
+
+	var backend ruleBackend
+	svc, denied, err := r.SelectServices(ctx, argonaut, ingress)
+	if err != nil {
+		log.FromContext(ctx).Info("Found no Service matching selector", "selector", ingress.ServiceSelector, "error", err.Error())
+	}
+	for _, service := range denied {
+		log.FromContext(ctx).Info("Service in other namespace not granted", "argonaut", argonaut.Name, "service", service.Name, "namespace", service.Namespace)
+		backend.Denied = append(backend.Denied, service.Namespace+"/"+service.Name)
+	}
+
+	switch len(svc) {
+	case 0:
+		backend.Warning = "serviceSelector matches no Service"
+		return backend
+	case 1:
+	default:
+		// cloudflared only ever uses the first entry for a hostname, so pick one we can stand by.
+		sort.Slice(svc, func(i, j int) bool {
+			return svc[i].Namespace+"/"+svc[i].Name < svc[j].Namespace+"/"+svc[j].Name
+		})
+		backend.Warning = fmt.Sprintf("serviceSelector matches %d Services, using %s/%s", len(svc), svc[0].Namespace, svc[0].Name)
+	}
+	if denied, warning := r.externalNameGranted(ctx, argonaut, &svc[0]); len(warning) != 0 {
+		backend.Denied = append(backend.Denied, denied...)
+		backend.Warning = warning
+		return backend
+	}
+
+	service, warning := r.serviceOrigin(ctx, &svc[0], ingress.Port, ingress.Protocol)
+	backend.Service = service
+	if len(warning) != 0 {
+		backend.Warning = warning
+	}
+	return backend
+}
+
+// Resolves a rule pointing at a Service by name.
+func (r *ArgonautReconciler) resolveServiceRef(ctx context.Context, argonaut *argonautv1.Argonaut, ref *argonautv1.ArgonautServiceRef, protocol argonautv1.Protocol) ruleBackend {
+	var backend ruleBackend
+	namespace := ref.Namespace
+	if len(namespace) == 0 {
+		namespace = argonaut.Namespace
+	}
+
+	var service v1.Service
+	if err := r.Get(ctx, client.ObjectKey{Name: ref.Name, Namespace: namespace}, &service); err != nil {
+		if !errors.IsNotFound(err) {
+			log.FromContext(ctx).Error(err, "unable to get Service", "service", ref.Name, "namespace", namespace)
+		}
+		backend.Warning = fmt.Sprintf("Service %s/%s not found", namespace, ref.Name)
+		return backend
+	}
+	granted, err := r.Granted(ctx, argonaut, namespace, service.Labels)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "unable to check ServiceGrants", "namespace", namespace)
+	}
+	if !granted {
+		backend.Denied = []string{namespace + "/" + ref.Name}
+		backend.Warning = fmt.Sprintf("no ServiceGrant in %s allows Service %s", namespace, ref.Name)
+		return backend
+	}
+	if denied, warning := r.externalNameGranted(ctx, argonaut, &service); len(warning) != 0 {
+		backend.Denied, backend.Warning = denied, warning
+		return backend
+	}
+
+	backend.Service, backend.Warning = r.serviceOrigin(ctx, &service, ref.Port, protocol)
+	return backend
+}
+
+// Checks where an ExternalName Service points. A name in the cluster is just another Service,
+// and needs a ServiceGrant like one selected directly. Returns the denied Service and a warning
+// if it may not be used.
+func (r *ArgonautReconciler) externalNameGranted(ctx context.Context, argonaut *argonautv1.Argonaut, service *v1.Service) ([]string, string) {
+	if service.Spec.Type != v1.ServiceTypeExternalName {
+		return nil, ""
+	}
+	name, namespace, inCluster, err := r.externalNameTarget(ctx, service.Spec.ExternalName)
+	if err != nil {
+		return nil, fmt.Sprintf("ExternalName %s of Service %s/%s: %v", service.Spec.ExternalName, service.Namespace, service.Name, err)
+	}
+	if !inCluster {
+		return nil, ""
+	}
+	// Targets we can't find are only allowed by grants for the whole namespace.
+	var target v1.Service
+	if len(name) != 0 {
+		if err := r.Get(ctx, client.ObjectKey{Name: name, Namespace: namespace}, &target); err != nil && !errors.IsNotFound(err) {
+			return nil, err.Error()
+		}
+		if target.Spec.Type == v1.ServiceTypeExternalName {
+			return nil, fmt.Sprintf("ExternalName of Service %s/%s points at ExternalName Service %s/%s", service.Namespace, service.Name, namespace, name)
+		}
+	}
+	granted, err := r.Granted(ctx, argonaut, namespace, target.Labels)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "unable to check ServiceGrants", "namespace", namespace)
+	}
+	if !granted {
+		return []string{namespace + "/" + name}, fmt.Sprintf("no ServiceGrant in %s allows Service %s behind ExternalName Service %s/%s", namespace, name, service.Namespace, service.Name)
+	}
+	return nil, ""
+}
+
+// Works out whether an ExternalName resolves inside the cluster, and to which Service and
+// namespace. Names ending in .svc or .svc.<cluster domain> do, as do relative names whose last
+// label is a namespace, which the search path of cloudflared turns into one. A single label is
+// looked up in whatever namespace cloudflared runs in, so we refuse it.
+func (r *ArgonautReconciler) externalNameTarget(ctx context.Context, externalName string) (string, string, bool, error) {
+	domain := r.ClusterDomain
+	if len(domain) == 0 {
+		domain = "cluster.local"
+	}
+	absolute := strings.HasSuffix(externalName, ".")
+	name := strings.ToLower(strings.TrimSuffix(externalName, "."))
+	for _, suffix := range []string{".svc", ".svc." + strings.ToLower(domain)} {
+		if strings.HasSuffix(name, suffix) {
+			labels := strings.Split(strings.TrimSuffix(name, suffix), ".")
+			if len(labels) == 1 {
+				return "", labels[0], true, nil
+			}
+			return labels[len(labels)-2], labels[len(labels)-1], true, nil
+		}
+	}
+	if absolute {
+		return "", "", false, nil
+	}
+
+	labels := strings.Split(name, ".")
+	if len(labels) == 1 {
+		return "", "", false, fmt.Errorf("a single label is relative to the namespace cloudflared runs in")
+	}
+	var namespace v1.Namespace
+	if err := r.Get(ctx, client.ObjectKey{Name: labels[len(labels)-1]}, &namespace); err != nil {
+		if errors.IsNotFound(err) {
+			return "", "", false, nil
+		}
+		return "", "", false, err
+	}
+	return labels[len(labels)-2], namespace.Name, true, nil
+}
+
+// Picks a port of an Endpoints subset by name or number, like servicePort does for Services.
+func endpointPort(endpoints *v1.Endpoints, ports []v1.EndpointPort, port *intstr.IntOrString) (*v1.EndpointPort, string) {
+	if len(ports) == 0 {
+		return nil, fmt.Sprintf("Endpoints %s/%s have no ports", endpoints.Namespace, endpoints.Name)
+	}
+	if port == nil {
+		return &ports[0], ""
+	}
+	for i := range ports {
+		if port.Type == intstr.String && ports[i].Name == port.StrVal {
+			return &ports[i], ""
+		}
+		if port.Type == intstr.Int && ports[i].Port == port.IntVal {
+			return &ports[i], ""
+		}
+	}
+	return nil, fmt.Sprintf("Endpoints %s/%s have no port %s", endpoints.Namespace, endpoints.Name, port.String())
+}
+
+// Builds the cloudflared origin for a port of a Service, addressed by its cluster DNS name so
+// recreating the Service does not change the config. Returns a warning instead if the port can't
+// be found.
+func (r *ArgonautReconciler) serviceOrigin(ctx context.Context, service *v1.Service, port *intstr.IntOrString, protocol argonautv1.Protocol) (string, string) {
+	if service.Spec.Type == v1.ServiceTypeExternalName && port != nil && port.Type == intstr.Int {
+		// The name resolves to something outside the cluster, there is nothing to map the port to.
+		return originScheme(protocol, nil) + "://" + service.Spec.ExternalName + ":" + port.String(), ""
+	}
+
+	p, warning := servicePort(service, port)
+	if p == nil {
+		return "", warning
+	}
+	host := r.serviceHostname(service)
+	number := p.Port
+	switch {
+	case service.Spec.Type == v1.ServiceTypeExternalName:
+		host = service.Spec.ExternalName
+	case service.Spec.ClusterIP == v1.ClusterIPNone:
+		// Headless, the name resolves to the pods themselves so we have to use their port.
+		var err error
+		if number, err = r.headlessTargetPort(ctx, service, p); err != nil {
+			return "", err.Error()
+		}
+	}
+	return originScheme(protocol, p) + "://" + host + ":" + strconv.Itoa(int(number)), warning
+}
+
+// URL scheme cloudflared uses to talk to an origin. Without a protocol on the rule we go for
+// https if the Service port says so through its appProtocol or name, http otherwise.
+func originScheme(protocol argonautv1.Protocol, port *v1.ServicePort) string {
+	if len(protocol) != 0 {
+		return string(protocol)
+	}
+	if port == nil {
+		return string(argonautv1.ProtocolHTTP)
+	}
+	if port.AppProtocol != nil && strings.EqualFold(*port.AppProtocol, "https") {
+		return string(argonautv1.ProtocolHTTPS)
+	}
+	if port.Name == "https" || strings.HasPrefix(port.Name, "https-") {
+		return string(argonautv1.ProtocolHTTPS)
+	}
+	return string(argonautv1.ProtocolHTTP)
+}
+
+// Cluster DNS name of a Service.
+func (r *ArgonautReconciler) serviceHostname(service *v1.Service) string {
+	domain := r.ClusterDomain
+	if len(domain) == 0 {
+		domain = "cluster.local"
+	}
+	return service.Name + "." + service.Namespace + ".svc." + domain
+}
+
+// Port the pods behind a headless Service listen on. Named target ports are looked up in the
+// Endpoints of the Service.
+func (r *ArgonautReconciler) headlessTargetPort(ctx context.Context, service *v1.Service, port *v1.ServicePort) (int32, error) {
+	switch {
+	case port.TargetPort.Type == intstr.Int && port.TargetPort.IntVal != 0:
+		return port.TargetPort.IntVal, nil
+	case port.TargetPort.Type == intstr.Int || len(port.TargetPort.StrVal) == 0:
+		return port.Port, nil
+	}
+
+	var endpoints v1.Endpoints
+	if err := r.Get(ctx, client.ObjectKey{Name: service.Name, Namespace: service.Namespace}, &endpoints); err != nil {
+		return 0, fmt.Errorf("headless Service %s/%s has no Endpoints to resolve port %s", service.Namespace, service.Name, port.TargetPort.StrVal)
+	}
+	for _, subset := range endpoints.Subsets {
+		for _, p := range subset.Ports {
+			if p.Name == port.Name {
+				return p.Port, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("headless Service %s/%s has no ready Endpoints for port %s", service.Namespace, service.Name, port.TargetPort.StrVal)
+}
+
+// Picks a port of a Service by name or number. Without one the Service should have a single
+// port, we take the first if it has more.
+func servicePort(service *v1.Service, port *intstr.IntOrString) (*v1.ServicePort, string) {
+	ports := service.Spec.Ports
+	if len(ports) == 0 {
+		return nil, fmt.Sprintf("Service %s/%s has no ports", service.Namespace, service.Name)
+	}
+	if port == nil {
+		if len(ports) > 1 {
+			return &ports[0], fmt.Sprintf("Service %s/%s has %d ports and the rule sets none, using %d", service.Namespace, service.Name, len(ports), ports[0].Port)
+		}
+		return &ports[0], ""
+	}
+	for i := range ports {
+		if port.Type == intstr.String && ports[i].Name == port.StrVal {
+			return &ports[i], ""
+		}
+		if port.Type == intstr.Int && ports[i].Port == port.IntVal {
+			return &ports[i], ""
+		}
+	}
+	return nil, fmt.Sprintf("Service %s/%s has no port %s", service.Namespace, service.Name, port.String())
+}
+
+// Resolve all ingress rules of an Argonaut for its status.
+func (r *ArgonautReconciler) ResolveIngressRules(ctx context.Context, argonaut *argonautv1.Argonaut) []argonautv1.ArgonautRuleStatus {
+	var rules []argonautv1.ArgonautRuleStatus
+	for _, ingress := range argonaut.Spec.Ingress {
+		backend := r.ResolveIngressRule(ctx, argonaut, ingress)
+		rule := argonautv1.ArgonautRuleStatus{
+			Hostname: ingress.Hostname,
+			Path:     ingress.Path,
+			Denied:   backend.Denied,
+			Warning:  backend.Warning,
+		}
+		if len(backend.Service) != 0 {
+			rule.Services = []string{backend.Service}
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"fmt"
+	argonautv1 "github.com/laetho/argonaut/api/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+	"strings"
+)
+
+// Argonauts sharing a tunnel end up in one cloudflared config, where the most specific rule wins
+// whoever wrote it. So every hostname is served by a single Argonaut: the one holding the registry
+// claim on its DNS record, or else the oldest asking for it. Rules of the others are left out.
+
+// The Argonaut serving each hostname, lowercased, among those sharing a tunnel. Rules without a
+// hostname are claimed under the empty hostname.
+func hostnameOwners(argonauts []argonautv1.Argonaut) map[string]types.NamespacedName {
+	owners := make(map[string]types.NamespacedName)
+	holders := make(map[string]bool)
+	for i := range argonauts {
+		argonaut := &argonauts[i]
+		key := types.NamespacedName{Namespace: argonaut.Namespace, Name: argonaut.Name}
+		for _, ingress := range argonaut.Spec.Ingress {
+			hostname := strings.ToLower(ingress.Hostname)
+			holds, excluded := hostnameClaim(argonaut, hostname)
+			if excluded || holders[hostname] && !holds {
+				continue
+			}
+			current, ok := owners[hostname]
+			if !ok || holds && !holders[hostname] || olderArgonaut(argonaut, argonautByKey(argonauts, current)) {
+				owners[hostname] = key
+				holders[hostname] = holds
+			}
+		}
+	}
+	return owners
+}
+
+// Whether an Argonaut serves a hostname on its tunnel.
+func ownsHostname(owners map[string]types.NamespacedName, argonaut *argonautv1.Argonaut, hostname string) bool {
+	owner, ok := owners[strings.ToLower(hostname)]
+	return ok && owner.Namespace == argonaut.Namespace && owner.Name == argonaut.Name
+}
+
+// What the DNS status of an Argonaut says about its claim on a hostname: whether it holds the
+// registry claim, and whether the record belongs to someone else.
+func hostnameClaim(argonaut *argonautv1.Argonaut, hostname string) (bool, bool) {
+	for _, status := range argonaut.Status.Hostnames {
+		if !strings.EqualFold(status.Hostname, hostname) {
+			continue
+		}
+		if status.Reason == reasonRecordNotOwned {
+			return false, true
+		}
+		return len(status.Target) != 0 && len(status.Reason) == 0, false
+	}
+	return false, false
+}
+
+// Orders Argonauts by age, then namespace and name so ties are settled the same way every time.
+func olderArgonaut(a *argonautv1.Argonaut, b *argonautv1.Argonaut) bool {
+	if b == nil {
+		return true
+	}
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	if a.Namespace != b.Namespace {
+		return a.Namespace < b.Namespace
+	}
+	return a.Name < b.Name
+}
+
+// Finds an Argonaut in a list by namespace and name.
+func argonautByKey(argonauts []argonautv1.Argonaut, key types.NamespacedName) *argonautv1.Argonaut {
+	for i := range argonauts {
+		if argonauts[i].Namespace == key.Namespace && argonauts[i].Name == key.Name {
+			return &argonauts[i]
+		}
+	}
+	return nil
+}
+
+// Hostnames of an Argonaut whose DNS it looks after, leaving out those another Argonaut on the
+// tunnel serves. Hostnames nobody serves stay, the DNS status tells why.
+func claimableHostnames(owners map[string]types.NamespacedName, argonaut *argonautv1.Argonaut) []string {
+	var hostnames []string
+	for _, hostname := range argonautHostnames(argonaut) {
+		if _, ok := owners[strings.ToLower(hostname)]; !ok || ownsHostname(owners, argonaut, hostname) {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+	return hostnames
+}
+
+// Drops the backends of rules the tunnel does not serve for this Argonaut from the rule statuses,
+// warning about them instead. Returns the hostnames another Argonaut serves.
+func markUnownedRules(owners map[string]types.NamespacedName, argonaut *argonautv1.Argonaut, tunnel string) []string {
+	var conflicts []string
+	seen := make(map[string]bool)
+	for i := range argonaut.Status.Rules {
+		rule := &argonaut.Status.Rules[i]
+		if ownsHostname(owners, argonaut, rule.Hostname) {
+			continue
+		}
+		rule.Services = nil
+		owner, ok := owners[strings.ToLower(rule.Hostname)]
+		if !ok {
+			rule.Warning = "DNS record of hostname is not ours, see status.hostnames"
+			continue
+		}
+		rule.Warning = fmt.Sprintf("hostname is served by Argonaut %s on ArgoTunnel %s", owner, tunnel)
+		if !seen[rule.Hostname] {
+			seen[rule.Hostname] = true
+			conflicts = append(conflicts, rule.Hostname)
+		}
+	}
+	return conflicts
+}
@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	argonautv1 "github.com/laetho/argonaut/api/v1beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Condition reasons.
+const (
+	reasonReconciling           = "Reconciling"
+	reasonReconciled            = "Reconciled"
+	reasonCloudflareLoginFailed = "CloudflareLoginFailed"
+	reasonTunnelFailed          = "TunnelFailed"
+	reasonTunnelSwitching       = "TunnelSwitching"
+	reasonConfigFailed          = "ConfigFailed"
+	reasonDeploymentFailed      = "DeploymentFailed"
+	reasonDeploymentUnavailable = "DeploymentUnavailable"
+	reasonDNSFailed             = "DNSFailed"
+	reasonZoneNotFound          = "ZoneNotFound"
+	reasonRecordNotOwned        = "RecordNotOwned"
+	reasonRecordConflict        = "RecordConflict"
+	reasonRecordConflictSkipped = "RecordConflictSkipped"
+	reasonHostnameConflict      = "HostnameConflict"
+	reasonCAPoolNotAllowed      = "CAPoolNotAllowed"
+	reasonWaitingForArgoTunnel  = "WaitingForArgoTunnel"
+	reasonArgoTunnelFailed      = "ArgoTunnelFailed"
+)
+
+// Sets a condition, keeping the transition time if the status did not change.
+func setCondition(conditions *[]metav1.Condition, generation int64, conditionType string, status metav1.ConditionStatus, reason string, message string) {
+	meta.SetStatusCondition(conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// Marks the given conditions as Unknown if they have not been set yet, so a reconcile that stops
+// early doesn't leave them out.
+func initConditions(conditions *[]metav1.Condition, generation int64, conditionTypes ...string) {
+	for _, conditionType := range conditionTypes {
+		if meta.FindStatusCondition(*conditions, conditionType) == nil {
+			setCondition(conditions, generation, conditionType, metav1.ConditionUnknown, reasonReconciling, "")
+		}
+	}
+}
+
+// Sets Ready from the given conditions. It takes over reason and message from the first one that
+// is not True.
+func setReadyCondition(conditions *[]metav1.Condition, generation int64, conditionTypes ...string) {
+	for _, conditionType := range conditionTypes {
+		cond := meta.FindStatusCondition(*conditions, conditionType)
+		if cond == nil {
+			setCondition(conditions, generation, argonautv1.ConditionReady, metav1.ConditionUnknown, reasonReconciling, "")
+			return
+		}
+		if cond.Status != metav1.ConditionTrue {
+			status := metav1.ConditionFalse
+			if cond.Status == metav1.ConditionUnknown {
+				status = metav1.ConditionUnknown
+			}
+			setCondition(conditions, generation, argonautv1.ConditionReady, status, cond.Reason, cond.Message)
+			return
+		}
+	}
+	setCondition(conditions, generation, argonautv1.ConditionReady, metav1.ConditionTrue, reasonReconciled, "")
+}
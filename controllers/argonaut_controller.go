@@ -21,27 +21,73 @@ import (
 	"fmt"
 	"github.com/cloudflare/cloudflare-go"
 	argonautv1 "github.com/laetho/argonaut/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
 	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"strings"
+	"time"
 )
 
+// Conditions making up Ready on an Argonaut.
+var argonautConditions = []string{
+	argonautv1.ConditionTunnelReady,
+	argonautv1.ConditionConfigReady,
+	argonautv1.ConditionDeploymentAvailable,
+	argonautv1.ConditionDNSReady,
+}
+
 // ArgonautReconciler reconciles a Argonaut object
 type ArgonautReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// DNS domain of the cluster, used to address Services from cloudflared. Defaults to
+	// cluster.local.
+	ClusterDomain string
+
+	// cloudflared image for tunnels that don't set one.
+	DefaultImage string
+
+	// Identifies this cluster in the TXT records claiming DNS records, so operators in several
+	// clusters can share a zone.
+	ClusterID string
+
+	zones zoneCache
+
+	// Tunnels seen and DNS published recently, see cloudflareResync.
+	tunnelsSeen syncCache
+	dnsSynced   syncCache
 }
 
 //+kubebuilder:rbac:groups=argonaut.metalabs.no,resources=argonauts,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=argonaut.metalabs.no,resources=argonauts/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=argonaut.metalabs.no,resources=argonauts/finalizers,verbs=update
-//+kubebuilder:rbac:groups=core,resources=endpoints,verbs=get;list;watch
-//+kubebuilder:rbac:groups=core,resources=deployments,verbs=get;list;watch;create;update;patch;delete
-//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups=argonaut.metalabs.no,resources=argotunnels,verbs=get;list;watch
+//+kubebuilder:rbac:groups=argonaut.metalabs.no,resources=servicegrants,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=endpoints,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=autoscaling,resources=horizontalpodautoscalers,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.8.3/pkg/reconcile
@@ -50,63 +96,253 @@ func (r *ArgonautReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 
 	var argonaut argonautv1.Argonaut
 	if err := r.Get(ctx, req.NamespacedName, &argonaut); err != nil {
+		if errors.IsNotFound(err) {
+			// Removal is handled through the finalizer before we get here.
+			return ctrl.Result{}, nil
+		}
 		log.FromContext(ctx).Error(err, "unable to fetch Argonaut resource")
-		// Potentially handle removal?
-		return ctrl.Result{}, client.IgnoreNotFound(err)
+		return ctrl.Result{}, err
 	}
 
-	cfc, err := r.CloudflareLogin(ctx, &argonaut)
+	if !argonaut.DeletionTimestamp.IsZero() {
+		return r.FinalizeArgonaut(ctx, &argonaut)
+	}
+
+	if _, err := r.EnsureFinalizer(ctx, &argonaut); err != nil {
+		log.FromContext(ctx).Error(err, "unable to add finalizer", "name", argonaut.Name)
+		return ctrl.Result{}, err
+	}
+
+	result, err := r.ReconcileArgonaut(ctx, &argonaut)
+
+	// Update status on the Argonaut instance, also when reconciliation failed so the
+	// conditions tell why.
+	argonaut.Status.ObservedGeneration = argonaut.Generation
+	setReadyCondition(&argonaut.Status.Conditions, argonaut.Generation, argonautConditions...)
+	if err := r.Status().Update(ctx, &argonaut); err != nil {
+		log.FromContext(ctx).Error(err, "unable to update status on Argonaut", "name", argonaut.Name)
+		return ctrl.Result{}, err
+	}
+	return result, err
+}
+
+// Reconciles the Cloudflare side and the cloudflared Deployment of an Argonaut, setting its
+// conditions along the way.
+func (r *ArgonautReconciler) ReconcileArgonaut(ctx context.Context, argonaut *argonautv1.Argonaut) (ctrl.Result, error) {
+	initConditions(&argonaut.Status.Conditions, argonaut.Generation, argonautConditions...)
+
+	cfc, err := r.CloudflareLogin(ctx, argonaut.Spec.CFAuthSecret)
 	if err != nil {
+		r.Recorder.Event(argonaut, v1.EventTypeWarning, eventCloudflareAuthFailed, err.Error())
+		setCondition(&argonaut.Status.Conditions, argonaut.Generation, argonautv1.ConditionTunnelReady, metav1.ConditionFalse, reasonCloudflareLoginFailed, err.Error())
 		return ctrl.Result{}, err
 	}
 	log.FromContext(ctx).Info("reconcile of Argonaut instance", "instance", argonaut.Name, "cfaccount", cfc.AccountID)
 
+	argonaut.Status.Rules = r.ResolveIngressRules(ctx, argonaut)
+	if err := r.ReconcileEndpointsServices(ctx, argonaut); err != nil {
+		log.FromContext(ctx).Error(err, "unable to reconcile endpoints Services")
+		setCondition(&argonaut.Status.Conditions, argonaut.Generation, argonautv1.ConditionConfigReady, metav1.ConditionFalse, reasonConfigFailed, err.Error())
+		return ctrl.Result{}, err
+	}
+
+	shared, err := r.GetSharedArgoTunnel(ctx, argonaut)
+	if err != nil {
+		setCondition(&argonaut.Status.Conditions, argonaut.Generation, argonautv1.ConditionTunnelReady, metav1.ConditionFalse, reasonArgoTunnelFailed, err.Error())
+		return ctrl.Result{}, err
+	}
+
+	if shared != nil {
+		return r.ReconcileSharedArgonaut(ctx, cfc, argonaut, shared)
+	}
+
+	// Rules with a CA bundle cloudflared can't mount are left out of the config, say so here.
+	missing, err := r.MissingCABundles(ctx, argonaut.Namespace, uniqueCABundles(argonautOriginRequests(argonaut)))
+	if err != nil {
+		setCondition(&argonaut.Status.Conditions, argonaut.Generation, argonautv1.ConditionConfigReady, metav1.ConditionFalse, reasonConfigFailed, err.Error())
+		return ctrl.Result{}, err
+	}
+	markMissingCABundles(argonaut, missing)
+
 	// Reconciliation flow for CloudFlare Resources
-	// 1. [ ] Reconcile Argo Tunnel
-	// 2. [ ] Reconcile DNS Records + Zone Check (Require manual zone creation?)
+	// 1. [x] Reconcile Argo Tunnel
+	// 2. [x] Reconcile DNS Records + Zone Check (Require manual zone creation?)
 	// 3. [ ] Reconcile TLS Certificates
 	// ?. [ ] Support Load Balancers
-	tun, err := r.ReconcileArgoTunnel(ctx, cfc, &argonaut)
+	host := argonautTunnelHost(argonaut)
+	_, creds, waiting, err := r.ReconcileTunnelHost(ctx, cfc, host)
 	if err != nil {
-		log.FromContext(ctx).Error(err, "unable to reconcile tunnel, requeuing", tun)
-		return ctrl.Result{Requeue: true, RequeueAfter: 60000000000}, err
+		r.recordCloudflareAuthError(argonaut, err)
+		return ctrl.Result{}, err
 	}
 
-	if err := r.ReconcileDNS(ctx, cfc, &argonaut, tun); err != nil {
+	if err := r.ReconcileDNS(ctx, cfc, argonaut, &cloudflare.ArgoTunnel{ID: argonaut.Status.TunnelId}, argonautHostnames(argonaut)); err != nil {
 		log.FromContext(ctx).Error(err, "unable to reconcile dns entries")
+		r.recordCloudflareAuthError(argonaut, err)
+		setCondition(&argonaut.Status.Conditions, argonaut.Generation, argonautv1.ConditionDNSReady, metav1.ConditionFalse, reasonDNSFailed, err.Error())
 		return ctrl.Result{}, err
 	}
+	published := setDNSCondition(argonaut)
 
-	if err := r.ReconcileArgonautDeployment(ctx, &argonaut); err != nil {
-		log.FromContext(ctx).Error(err, "unable to reconcile Deployment", "name", argonaut.Name)
+	retiring, err := r.RetirePreviousArgoTunnel(ctx, cfc, host, creds)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "unable to retire previous tunnel", "tunnel", argonaut.Status.PreviousTunnelId)
 		return ctrl.Result{}, err
 	}
 
-	// Update status on the Argonaut instance.
-	if err := r.Status().Update(ctx, &argonaut); err != nil {
-		log.FromContext(ctx).Error(err, "unable to update status on Argonaut", argonaut)
+	if waiting || retiring {
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+	if !published {
+		return ctrl.Result{RequeueAfter: dnsRetryInterval}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// Fetch the ArgoTunnel an Argonaut contributes to. Returns nil if the Argonaut runs its own tunnel.
+// Once attached an Argonaut stays attached, it won't start a tunnel of its own if the ArgoTunnel
+// goes away.
+func (r *ArgonautReconciler) GetSharedArgoTunnel(ctx context.Context, argonaut *argonautv1.Argonaut) (*argonautv1.ArgoTunnel, error) {
+	var tunnel argonautv1.ArgoTunnel
+	if err := r.Get(ctx, client.ObjectKey{Name: argonaut.Spec.ArgoTunnelName}, &tunnel); err != nil {
+		if !errors.IsNotFound(err) {
+			return nil, err
+		}
+		if len(argonaut.Status.ArgoTunnel) != 0 {
+			return nil, fmt.Errorf("%s: %s", errArgoTunnelNotFound, argonaut.Status.ArgoTunnel)
+		}
+		return nil, nil
+	}
+	if len(argonaut.Status.ArgoTunnel) == 0 && len(argonaut.Status.TunnelId) != 0 {
+		return nil, fmt.Errorf("%s: %s", errArgoTunnelConflict, tunnel.Name)
+	}
+	return &tunnel, nil
+}
+
+// Points the DNS records of an Argonaut at the tunnel of the shared ArgoTunnel. The ArgoTunnel
+// picks up our ingress rules by itself, its conditions are reflected on the Argonaut.
+func (r *ArgonautReconciler) ReconcileSharedArgonaut(ctx context.Context, cfc *cloudflare.API, argonaut *argonautv1.Argonaut, tunnel *argonautv1.ArgoTunnel) (ctrl.Result, error) {
+	argonaut.Status.ArgoTunnel = tunnel.Name
+	conditions := &argonaut.Status.Conditions
+
+	waiting := fmt.Sprintf("waiting for ArgoTunnel %s", tunnel.Name)
+	if cond := meta.FindStatusCondition(tunnel.Status.Conditions, argonautv1.ConditionDeploymentAvailable); cond != nil {
+		setCondition(conditions, argonaut.Generation, argonautv1.ConditionDeploymentAvailable, cond.Status, cond.Reason, cond.Message)
+	} else {
+		setCondition(conditions, argonaut.Generation, argonautv1.ConditionDeploymentAvailable, metav1.ConditionUnknown, reasonWaitingForArgoTunnel, waiting)
+	}
+	owners, err := r.sharedHostnameOwners(ctx, argonaut, tunnel)
+	if err != nil {
+		setCondition(conditions, argonaut.Generation, argonautv1.ConditionConfigReady, metav1.ConditionFalse, reasonConfigFailed, err.Error())
 		return ctrl.Result{}, err
 	}
+	conflicts := markUnownedRules(owners, argonaut, tunnel.Name)
+	rejected := markSharedCAPools(argonaut, tunnel.Name)
+	switch {
+	case !argonautAttached(tunnel, argonaut):
+		setCondition(conditions, argonaut.Generation, argonautv1.ConditionConfigReady, metav1.ConditionFalse, reasonWaitingForArgoTunnel, waiting)
+	case rejected:
+		message := fmt.Sprintf("caPool is not allowed on an Argonaut sharing ArgoTunnel %s, see status.rules", tunnel.Name)
+		setCondition(conditions, argonaut.Generation, argonautv1.ConditionConfigReady, metav1.ConditionFalse, reasonCAPoolNotAllowed, message)
+	case len(conflicts) != 0:
+		message := fmt.Sprintf("hostnames served by another Argonaut on ArgoTunnel %s, see status.rules: %s", tunnel.Name, strings.Join(conflicts, ", "))
+		setCondition(conditions, argonaut.Generation, argonautv1.ConditionConfigReady, metav1.ConditionFalse, reasonHostnameConflict, message)
+	default:
+		setCondition(conditions, argonaut.Generation, argonautv1.ConditionConfigReady, metav1.ConditionTrue, reasonReconciled, "merged into ArgoTunnel "+tunnel.Name)
+	}
+
+	if len(tunnel.Status.TunnelId) == 0 {
+		log.FromContext(ctx).Info("waiting for ArgoTunnel to create its tunnel", "argotunnel", tunnel.Name)
+		setCondition(conditions, argonaut.Generation, argonautv1.ConditionTunnelReady, metav1.ConditionFalse, reasonWaitingForArgoTunnel, waiting)
+		return ctrl.Result{}, nil
+	}
+	setCondition(conditions, argonaut.Generation, argonautv1.ConditionTunnelReady, metav1.ConditionTrue, reasonReconciled, "shared with ArgoTunnel "+tunnel.Name)
+
+	if err := r.ReconcileDNS(ctx, cfc, argonaut, &cloudflare.ArgoTunnel{ID: tunnel.Status.TunnelId}, claimableHostnames(owners, argonaut)); err != nil {
+		log.FromContext(ctx).Error(err, "unable to reconcile dns entries")
+		r.recordCloudflareAuthError(argonaut, err)
+		setCondition(conditions, argonaut.Generation, argonautv1.ConditionDNSReady, metav1.ConditionFalse, reasonDNSFailed, err.Error())
+		return ctrl.Result{}, err
+	}
+
+	// Tells the ArgoTunnel our DNS has moved over, see RetirePreviousArgoTunnel.
+	argonaut.Status.TunnelId = tunnel.Status.TunnelId
+	if !setDNSCondition(argonaut) {
+		return ctrl.Result{RequeueAfter: dnsRetryInterval}, nil
+	}
 	return ctrl.Result{}, nil
 }
 
-// SetupWithManager sets up the controller with the Manager.
+// Which Argonaut serves each hostname on a shared ArgoTunnel, judged with the status of the
+// Argonaut at hand as it stands rather than as last stored.
+func (r *ArgonautReconciler) sharedHostnameOwners(ctx context.Context, argonaut *argonautv1.Argonaut, tunnel *argonautv1.ArgoTunnel) (map[string]types.NamespacedName, error) {
+	argonauts, err := r.ListArgoTunnelArgonauts(ctx, tunnel)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for i := range argonauts {
+		if argonauts[i].Namespace == argonaut.Namespace && argonauts[i].Name == argonaut.Name {
+			argonauts[i] = *argonaut
+			found = true
+		}
+	}
+	if !found {
+		argonauts = append(argonauts, *argonaut)
+	}
+	return hostnameOwners(argonauts), nil
+}
+
+// Checks if the ArgoTunnel lists the Argonaut among those merged into its config.
+func argonautAttached(tunnel *argonautv1.ArgoTunnel, argonaut *argonautv1.Argonaut) bool {
+	for _, attached := range tunnel.Status.Argonauts {
+		if attached.Namespace == argonaut.Namespace && attached.Name == argonaut.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// SetupWithManager sets up the controller with the Manager. Watches the Services, Endpoints and
+// Secrets Argonauts refer to, along with the objects we create for them.
 func (r *ArgonautReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// Also used by the ArgoTunnelReconciler.
+	if err := setupIndexes(context.Background(), mgr); err != nil {
+		return err
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&argonautv1.Argonaut{}).
+		Watches(&source.Kind{Type: &argonautv1.ArgoTunnel{}}, handler.EnqueueRequestsFromMapFunc(r.argonautsForArgoTunnel)).
+		Watches(&source.Kind{Type: &v1.Service{}}, handler.EnqueueRequestsFromMapFunc(r.argonautsForService), builder.WithPredicates(serviceChangedPredicate)).
+		Watches(&source.Kind{Type: &v1.Endpoints{}}, handler.EnqueueRequestsFromMapFunc(r.argonautsForEndpoints)).
+		Watches(&source.Kind{Type: &argonautv1.ServiceGrant{}}, handler.EnqueueRequestsFromMapFunc(r.argonautsForServiceGrant)).
+		Watches(&source.Kind{Type: &v1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.argonautsForSecret)).
+		Watches(&source.Kind{Type: &v1.ConfigMap{}}, handler.EnqueueRequestsFromMapFunc(r.argonautsForConfigMap)).
+		Owns(&appsv1.Deployment{}, builder.WithPredicates(deploymentChangedPredicate)).
+		Owns(&v1.ConfigMap{}).
+		Owns(&v1.Secret{}).
+		Owns(&v1.Service{}, builder.WithPredicates(serviceChangedPredicate)).
+		Owns(&v1.Endpoints{}).
+		Owns(&policyv1.PodDisruptionBudget{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Owns(&autoscalingv2.HorizontalPodAutoscaler{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
 		Complete(r)
 }
 
-// Get a Cloudflare API instance. Uses login secrets from the secret referenced in the Argonaut spec.
-func (r *ArgonautReconciler) CloudflareLogin(ctx context.Context, argonaut *argonautv1.Argonaut) (*cloudflare.API, error) {
+// Get a Cloudflare API instance. Uses login secrets from the referenced secret, cfAuthSecret in
+// the Argonaut or ArgoTunnel spec.
+func (r *ArgonautReconciler) CloudflareLogin(ctx context.Context, ref v1.SecretReference) (*cloudflare.API, error) {
 	_ = log.FromContext(ctx)
 	// Get email and token from secret referenced in argonaut
 	var secret v1.Secret
-	err := r.Get(ctx, client.ObjectKey{Namespace: argonaut.Spec.CFAuthSecret.Namespace, Name: argonaut.Spec.CFAuthSecret.Name}, &secret)
+	err := r.Get(ctx, client.ObjectKey{Namespace: ref.Namespace, Name: ref.Name}, &secret)
 	if errors.IsNotFound(err) {
 		log.FromContext(ctx).Error(err, "Could not find Secret with credentials for Cloudflare API Login: ")
 		return nil, err
 	}
+	if err != nil {
+		return nil, err
+	}
 
 	token := secret.Data["token"]
 	accountid := secret.Data["accountid"]
@@ -116,24 +352,9 @@ func (r *ArgonautReconciler) CloudflareLogin(ctx context.Context, argonaut *argo
 
 	cfc, err := cloudflare.NewWithAPIToken(string(token))
 	if err != nil {
-		fmt.Println(err)
+		log.FromContext(ctx).Error(err, "unable to create Cloudflare API client")
 		return nil, err
 	}
 	cfc.AccountID = string(accountid)
 	return cfc, nil
 }
-
-// Get a map with EndpointsList keyed on hostname for an Argonaut resource
-func (r *ArgonautReconciler) EndpointsLists(ctx context.Context, argonaut *argonautv1.Argonaut) map[string]v1.EndpointsList {
-	eps := make(map[string]v1.EndpointsList)
-
-	for _, h := range argonaut.Spec.Ingress {
-		var el v1.EndpointsList
-		err := r.List(ctx, &el, client.MatchingLabels(h.EndpointsSelector.MatchLabels))
-		if errors.IsNotFound(err) {
-			fmt.Println("Did not find EndpointsList with selector:", h.EndpointsSelector.MatchLabels)
-		}
-		eps[h.Hostname] = el
-	}
-	return eps
-}
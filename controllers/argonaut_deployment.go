@@ -2,41 +2,128 @@ package controllers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/cloudflare/cloudflare-go"
 	argonautv1 "github.com/laetho/argonaut/api/v1beta1"
 	v1 "k8s.io/api/apps/v1"
 	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/log"
-	"time"
+	"sort"
+	"strings"
 
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-// Reconciles a Deployment for an Argonaut instance. This is a deployment of the
-// cloudflare/cloudflared container with config and secrets.
-func (r *ArgonautReconciler) ReconcileArgonautDeployment(ctx context.Context, argonaut *argonautv1.Argonaut) error {
+const (
+	// Pod template annotation with the checksum of the cloudflared config and credentials.
+	configChecksumAnnotation = "argonaut.metalabs.no/config-checksum"
 
-	ownerRef := metav1.OwnerReference{
-		APIVersion:         argonaut.APIVersion,
-		Kind:               argonaut.Kind,
-		Name:               argonaut.Name,
-		UID:                argonaut.UID,
-		Controller:         nil,
-		BlockOwnerDeletion: nil,
+	// Pod template annotation listing the annotations taken from the deployment settings, so
+	// removing one of them there is noticed.
+	podAnnotationsAnnotation = "argonaut.metalabs.no/pod-annotations"
+
+	// cloudflared image used unless the operator is started with another one.
+	DefaultCloudflaredImage = "cloudflare/cloudflared:2021.6.0"
+)
+
+// Requests of the cloudflared container unless the deployment settings ask for some. The
+// autoscaler measures CPU against the request, it can't scale pods without one.
+var defaultCloudflaredRequests = v12.ResourceList{
+	v12.ResourceCPU:    resource.MustParse("50m"),
+	v12.ResourceMemory: resource.MustParse("64Mi"),
+}
+
+// Reconciles a Deployment for an Argonaut or ArgoTunnel instance. This is a deployment of the
+// cloudflare/cloudflared container with config and secrets. The Deployment is only updated when it
+// differs from what we'd create, so pods roll exactly when the config or credentials change.
+func (r *ArgonautReconciler) ReconcileArgonautDeployment(ctx context.Context, host *tunnelHost, tun *cloudflare.ArgoTunnel, creds *tunnelCredentials, config string) (*v1.Deployment, error) {
+	desired, err := r.BuildDeployment(host, tun, creds, config)
+	if err != nil {
+		return nil, err
+	}
+
+	var deployment v1.Deployment
+	if err := r.Get(ctx, client.ObjectKey{Name: host.Name, Namespace: host.Namespace}, &deployment); err != nil {
+		if !errors.IsNotFound(err) {
+			return nil, err
+		}
+		if scaling := deploymentSettings(host).Autoscaling; scaling != nil {
+			// Start out at the minimum, the autoscaler takes it from there.
+			desired.Spec.Replicas = autoscalerMinReplicas(scaling)
+		}
+		if err := r.Create(ctx, desired); err != nil {
+			return nil, err
+		}
+		log.FromContext(ctx).Info("Created Argonaut Deployment", "name", desired.Name)
+		r.Recorder.Eventf(host.Owner, v12.EventTypeNormal, eventDeploymentCreated, "Created cloudflared Deployment %s/%s", desired.Namespace, desired.Name)
+		return desired, nil
+	}
+
+	if deploymentUpToDate(&deployment, desired) {
+		return &deployment, nil
+	}
+
+	generation := deployment.Generation
+	deployment.ObjectMeta.Labels = desired.Labels
+	deployment.OwnerReferences = desired.OwnerReferences
+	deployment.Spec.Selector = desired.Spec.Selector
+	deployment.Spec.Template = desired.Spec.Template
+	if desired.Spec.Replicas != nil {
+		deployment.Spec.Replicas = desired.Spec.Replicas
+	}
+	if err := r.Update(ctx, &deployment); err != nil {
+		return nil, err
 	}
+	log.FromContext(ctx).Info("Updated Argonaut Deployment", "name", deployment.Name)
+	if deployment.Generation != generation {
+		r.Recorder.Eventf(host.Owner, v12.EventTypeNormal, eventDeploymentRolled, "Rolled cloudflared Deployment %s/%s to generation %d", deployment.Namespace, deployment.Name, deployment.Generation)
+	}
+	return &deployment, nil
+}
+
+// Builds the cloudflared Deployment of a tunnel. The pod template carries a checksum of the config
+// and credentials so any change to either rolls the pods.
+func (r *ArgonautReconciler) BuildDeployment(host *tunnelHost, tun *cloudflare.ArgoTunnel, creds *tunnelCredentials, config string) (*v1.Deployment, error) {
+
+	settings := deploymentSettings(host)
 
 	labels := make(map[string]string)
-	labels["argonaut"] = argonaut.Name
+	for k, v := range settings.Labels {
+		labels[k] = v
+	}
+	labels["argonaut"] = host.Name
 
 	labelSelector := metav1.LabelSelector{
-		MatchLabels: labels,
+		MatchLabels: map[string]string{"argonaut": host.Name},
 	}
 
+	templateAnnotations := make(map[string]string)
+	var annotationKeys []string
+	for k, v := range settings.Annotations {
+		templateAnnotations[k] = v
+		annotationKeys = append(annotationKeys, k)
+	}
+	if len(annotationKeys) != 0 {
+		sort.Strings(annotationKeys)
+		templateAnnotations[podAnnotationsAnnotation] = strings.Join(annotationKeys, ",")
+	}
+	templateAnnotations[tunnelIDAnnotation] = tun.ID
+	templateAnnotations[configChecksumAnnotation] = configChecksum(config, creds)
+
 	tunnelSecretVolume := v12.Volume{
 		Name: "tunnelsecret",
 		VolumeSource: v12.VolumeSource{
 			Secret: &v12.SecretVolumeSource{
-				SecretName: argonaut.Spec.ArgoTunnelName,
+				SecretName: creds.SecretName,
+				Items: []v12.KeyToPath{
+					{Key: creds.SecretKey, Path: "tunnel.json"},
+				},
 			},
 		},
 	}
@@ -46,7 +133,7 @@ func (r *ArgonautReconciler) ReconcileArgonautDeployment(ctx context.Context, ar
 		VolumeSource: v12.VolumeSource{
 			ConfigMap: &v12.ConfigMapVolumeSource{
 				LocalObjectReference: v12.LocalObjectReference{
-					Name: argonaut.Name,
+					Name: host.Name,
 				},
 			},
 		},
@@ -64,72 +151,171 @@ func (r *ArgonautReconciler) ReconcileArgonautDeployment(ctx context.Context, ar
 		MountPath: "/etc/cloudflare/config",
 	}
 
+	caVolumes, caVolumeMounts := caBundleVolumes(caBundles(host))
+
+	pullPolicy := settings.ImagePullPolicy
+	if len(pullPolicy) == 0 {
+		pullPolicy = v12.PullIfNotPresent
+	}
+	args := append([]string{"tunnel", "--config", "/etc/cloudflare/config/config.yaml"}, settings.Args...)
+
 	containerTemplate := v12.Container{
-		Name:                     "cloudflared",
-		Image:                    "cloudflare/cloudflared:2021.6.0",
-		Command:                  []string{"cloudflared"},
-		Args:                     []string{"tunnel", "--config", "/etc/cloudflare/config/config.yaml", "run"},
-		VolumeMounts:             append([]v12.VolumeMount{}, tunnelSecretVolumeMount, tunnelSecretConfigMount),
-		LivenessProbe:            nil,
-		ReadinessProbe:           nil,
+		Name:         "cloudflared",
+		Image:        r.cloudflaredImage(settings),
+		Command:      []string{"cloudflared"},
+		Args:         append(args, "run"),
+		Env:          settings.Env,
+		Resources:    cloudflaredResources(settings),
+		VolumeMounts: append([]v12.VolumeMount{tunnelSecretVolumeMount, tunnelSecretConfigMount}, caVolumeMounts...),
+		Ports: []v12.ContainerPort{
+			{Name: metricsPortName, ContainerPort: metricsPort, Protocol: v12.ProtocolTCP},
+		},
+		// A pod that lost its edge connections is taken out of rotation, and restarted if it
+		// does not recover.
+		LivenessProbe:            liveProbe(),
+		ReadinessProbe:           readyProbe(),
 		StartupProbe:             nil,
 		TerminationMessagePath:   "/dev/termination-log",
 		TerminationMessagePolicy: "File",
-		ImagePullPolicy:          "IfNotPresent",
-		Stdin:                    false,
-		StdinOnce:                false,
-		TTY:                      true,
+		ImagePullPolicy:          pullPolicy,
 	}
 
 	var deployment v1.Deployment
-	if err := r.Get(ctx, client.ObjectKey{Name: argonaut.Name, Namespace: argonaut.Namespace}, &deployment); err != nil {
-		// Create Deployment
-		var replicas int32 = 1
-
-		deployment.Name = argonaut.Name
-		deployment.Namespace = argonaut.Namespace
-		deployment.ObjectMeta.Labels = labels
-		deployment.OwnerReferences = append(deployment.OwnerReferences, ownerRef)
-		deployment.Spec.Selector = &labelSelector
-		deployment.Spec.Replicas = &replicas
-		deployment.Spec.Template.Name = argonaut.Name
-		deployment.Spec.Template.Labels = labels
-		deployment.Spec.Template.Spec.Volumes = append(deployment.Spec.Template.Spec.Volumes, tunnelSecretVolume)
-		deployment.Spec.Template.Spec.Volumes = append(deployment.Spec.Template.Spec.Volumes, tunnelConfigVolume)
-		deployment.Spec.Template.Spec.Containers = append(deployment.Spec.Template.Spec.Containers, containerTemplate)
-
-		//out, _ := yaml.Marshal(deployment)
-		//fmt.Println(string(out))
-
-		if err := r.Create(ctx, &deployment); err != nil {
-			return err
+	deployment.Name = host.Name
+	deployment.Namespace = host.Namespace
+	deployment.ObjectMeta.Labels = labels
+	deployment.Spec.Selector = &labelSelector
+	if settings.Autoscaling == nil {
+		deployment.Spec.Replicas = settings.Replicas
+	}
+	deployment.Spec.Template.Name = host.Name
+	deployment.Spec.Template.Labels = labels
+	deployment.Spec.Template.Annotations = templateAnnotations
+	deployment.Spec.Template.Spec.Volumes = append([]v12.Volume{tunnelSecretVolume, tunnelConfigVolume}, caVolumes...)
+	deployment.Spec.Template.Spec.Containers = []v12.Container{containerTemplate}
+	deployment.Spec.Template.Spec.ImagePullSecrets = settings.ImagePullSecrets
+	deployment.Spec.Template.Spec.NodeSelector = settings.NodeSelector
+	deployment.Spec.Template.Spec.Tolerations = settings.Tolerations
+	deployment.Spec.Template.Spec.Affinity = settings.Affinity
+	if settings.Affinity == nil && highlyAvailable(settings) {
+		deployment.Spec.Template.Spec.Affinity = defaultAntiAffinity(host)
+	}
+	deployment.Spec.Template.Spec.TopologySpreadConstraints = settings.TopologySpreadConstraints
+	deployment.Spec.Template.Spec.PriorityClassName = settings.PriorityClassName
+	if err := r.setHostOwner(host, &deployment); err != nil {
+		return nil, err
+	}
+	return &deployment, nil
+}
+
+// Compute resources of the cloudflared container, with the default requests if none are set.
+// Resources with a limit are left out, the API server makes the limit the request.
+func cloudflaredResources(settings *argonautv1.CloudflaredDeployment) v12.ResourceRequirements {
+	resources := *settings.Resources.DeepCopy()
+	if len(resources.Requests) != 0 {
+		return resources
+	}
+	for name, quantity := range defaultCloudflaredRequests {
+		if _, limited := resources.Limits[name]; limited {
+			continue
 		}
-		log.FromContext(ctx).Info("Created Argonaut Deployment", "name", deployment.Name)
-
-	} else {
-		// Update Deployment
-		deployment.Name = argonaut.Name
-		deployment.Namespace = argonaut.Namespace
-		deployment.ObjectMeta.Labels = labels
-		deployment.ObjectMeta.Annotations["argonaut.metalabs.no/reconciledAt"] = metav1.NewTime(time.Now()).String()
-		deployment.OwnerReferences = append([]metav1.OwnerReference{}, ownerRef)
-		deployment.Spec.Selector = &labelSelector
-		deployment.Spec.Template.Name = argonaut.Name
-		deployment.Spec.Template.Labels = labels
-		deployment.Spec.Template.Spec.Volumes = append([]v12.Volume{}, tunnelSecretVolume, tunnelConfigVolume)
-		deployment.Spec.Template.Spec.Containers = append([]v12.Container{}, containerTemplate)
-
-		if err := r.Update(ctx, &deployment); err != nil {
-			return err
+		if resources.Requests == nil {
+			resources.Requests = make(v12.ResourceList)
 		}
-		log.FromContext(ctx).Info("Updated Argonaut Deployment", "name", deployment.Name)
+		resources.Requests[name] = quantity.DeepCopy()
+	}
+	return resources
+}
+
+// Deployment settings of a tunnel, the defaults if it has none.
+func deploymentSettings(host *tunnelHost) *argonautv1.CloudflaredDeployment {
+	if host.Deployment == nil {
+		return &argonautv1.CloudflaredDeployment{}
+	}
+	return host.Deployment
+}
+
+// The cloudflared image to run, the tag replacing the tag or digest of the image if set.
+func (r *ArgonautReconciler) cloudflaredImage(settings *argonautv1.CloudflaredDeployment) string {
+	image := settings.Image
+	if len(image) == 0 {
+		image = r.DefaultImage
+	}
+	if len(image) == 0 {
+		image = DefaultCloudflaredImage
 	}
+	if len(settings.Tag) == 0 {
+		return image
+	}
+	return imageRepository(image) + ":" + settings.Tag
+}
+
+// The repository of an image reference, without tag or digest. The digest follows an @, and a
+// colon after the last slash starts the tag, before it's a registry port.
+func imageRepository(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+// Checks if a Deployment already has everything we'd set on it. Fields we leave out, like the
+// ones the API server defaults, don't count. Settings that can be removed again are compared
+// exactly, so dropping them from the deployment settings takes them off the Deployment.
+func deploymentUpToDate(deployment *v1.Deployment, desired *v1.Deployment) bool {
+	return equality.Semantic.DeepDerivative(desired.Labels, deployment.Labels) &&
+		equality.Semantic.DeepEqual(desired.OwnerReferences, deployment.OwnerReferences) &&
+		equality.Semantic.DeepDerivative(desired.Spec.Replicas, deployment.Spec.Replicas) &&
+		equality.Semantic.DeepDerivative(desired.Spec.Template, deployment.Spec.Template) &&
+		podSettingsUpToDate(&deployment.Spec.Template, &desired.Spec.Template)
+}
 
-	return nil
+// Compares the pod template fields taken from the deployment settings that DeepDerivative skips
+// when they are empty in the desired template.
+func podSettingsUpToDate(current *v12.PodTemplateSpec, desired *v12.PodTemplateSpec) bool {
+	if !equality.Semantic.DeepEqual(desired.Labels, current.Labels) ||
+		!equality.Semantic.DeepEqual(desired.Spec.NodeSelector, current.Spec.NodeSelector) ||
+		!equality.Semantic.DeepEqual(desired.Spec.Tolerations, current.Spec.Tolerations) ||
+		!equality.Semantic.DeepEqual(desired.Spec.Affinity, current.Spec.Affinity) ||
+		!equality.Semantic.DeepEqual(desired.Spec.TopologySpreadConstraints, current.Spec.TopologySpreadConstraints) ||
+		!equality.Semantic.DeepEqual(desired.Spec.ImagePullSecrets, current.Spec.ImagePullSecrets) ||
+		desired.Annotations[podAnnotationsAnnotation] != current.Annotations[podAnnotationsAnnotation] ||
+		desired.Spec.PriorityClassName != current.Spec.PriorityClassName ||
+		len(desired.Spec.Containers) != len(current.Spec.Containers) {
+		return false
+	}
+	for i := range desired.Spec.Containers {
+		want, have := &desired.Spec.Containers[i], &current.Spec.Containers[i]
+		// Env entries get defaults filled in, their number is enough to catch removals.
+		if len(want.Env) != len(have.Env) ||
+			!equality.Semantic.DeepEqual(want.Args, have.Args) ||
+			!equality.Semantic.DeepEqual(want.Resources, have.Resources) {
+			return false
+		}
+	}
+	return true
 }
 
-func (r *ArgonautReconciler) BuildDeployment(ctx context.Context) (v1.Deployment, error) {
-	var deploy v1.Deployment
+// Checksum of the rendered cloudflared config and the tunnel credentials it runs with.
+func configChecksum(config string, creds *tunnelCredentials) string {
+	h := sha256.New()
+	h.Write([]byte(config))
+	h.Write([]byte(creds.SecretName + "/" + creds.SecretKey))
+	h.Write([]byte(creds.AccountTag + creds.TunnelID + creds.TunnelSecret))
+	return hex.EncodeToString(h.Sum(nil))
+}
 
-	return deploy, nil
+// Reports whether the cloudflared Deployment is available, along with a short description of
+// its replicas.
+func deploymentAvailability(deployment *v1.Deployment) (bool, string) {
+	message := fmt.Sprintf("%d/%d replicas available", deployment.Status.AvailableReplicas, deployment.Status.Replicas)
+	for _, cond := range deployment.Status.Conditions {
+		if cond.Type == v1.DeploymentAvailable {
+			return cond.Status == v12.ConditionTrue, message
+		}
+	}
+	return false, message
 }
@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"github.com/cloudflare/cloudflare-go"
+	argonautv1 "github.com/laetho/argonaut/api/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"testing"
+)
+
+func TestCloudflaredImage(t *testing.T) {
+	digest := "sha256:4f5e2a5d3e5b1e6c9d1f7e8c2a0b9d8c7e6f5a4b3c2d1e0f9a8b7c6d5e4f3a2b1"
+	tests := []struct {
+		name     string
+		image    string
+		tag      string
+		fallback string
+		want     string
+	}{
+		{name: "default", want: DefaultCloudflaredImage},
+		{name: "operator default", fallback: "mirror.local/cloudflared:2021.9.0", want: "mirror.local/cloudflared:2021.9.0"},
+		{name: "tag on operator default", fallback: "mirror.local/cloudflared:2021.9.0", tag: "2021.10.0", want: "mirror.local/cloudflared:2021.10.0"},
+		{name: "image", image: "cloudflare/cloudflared:2021.9.0", want: "cloudflare/cloudflared:2021.9.0"},
+		{name: "tag", image: "cloudflare/cloudflared:2021.9.0", tag: "2021.10.0", want: "cloudflare/cloudflared:2021.10.0"},
+		{name: "tag on untagged image", image: "cloudflare/cloudflared", tag: "2021.10.0", want: "cloudflare/cloudflared:2021.10.0"},
+		{name: "registry port", image: "registry:5000/cloudflared", tag: "2021.10.0", want: "registry:5000/cloudflared:2021.10.0"},
+		{name: "registry port and tag", image: "registry:5000/cloudflared:2021.9.0", tag: "2021.10.0", want: "registry:5000/cloudflared:2021.10.0"},
+		{name: "digest", image: "cloudflare/cloudflared@" + digest, want: "cloudflare/cloudflared@" + digest},
+		{name: "tag on digest", image: "cloudflare/cloudflared@" + digest, tag: "2021.10.0", want: "cloudflare/cloudflared:2021.10.0"},
+		{name: "tag on tag and digest", image: "registry:5000/cloudflared:2021.9.0@" + digest, tag: "2021.10.0", want: "registry:5000/cloudflared:2021.10.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &ArgonautReconciler{DefaultImage: tt.fallback}
+			image := r.cloudflaredImage(&argonautv1.CloudflaredDeployment{Image: tt.image, Tag: tt.tag})
+			if image != tt.want {
+				t.Errorf("cloudflaredImage = %q, want %q", image, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeploymentUpToDateAnnotations(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := argonautv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	r := &ArgonautReconciler{Scheme: scheme}
+	tun := &cloudflare.ArgoTunnel{ID: "6ff42ae2-765d-4adf-8112-31c55c1551ef"}
+	creds := &tunnelCredentials{SecretName: "web-tunnel", SecretKey: "tunnel.json"}
+	build := func(annotations map[string]string) *argonautv1.Argonaut {
+		return &argonautv1.Argonaut{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "web", UID: "3c9b5e0e"},
+			Spec:       argonautv1.ArgonautSpec{Deployment: &argonautv1.CloudflaredDeployment{Annotations: annotations}},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		current  map[string]string
+		desired  map[string]string
+		upToDate bool
+	}{
+		{name: "none", upToDate: true},
+		{name: "same", current: map[string]string{"a": "1", "b": "2"}, desired: map[string]string{"a": "1", "b": "2"}, upToDate: true},
+		{name: "added", current: map[string]string{"a": "1"}, desired: map[string]string{"a": "1", "b": "2"}},
+		{name: "changed", current: map[string]string{"a": "1"}, desired: map[string]string{"a": "2"}},
+		{name: "removed", current: map[string]string{"a": "1", "b": "2"}, desired: map[string]string{"a": "1"}},
+		{name: "all removed", current: map[string]string{"a": "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current, err := r.BuildDeployment(argonautTunnelHost(build(tt.current)), tun, creds, "config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			desired, err := r.BuildDeployment(argonautTunnelHost(build(tt.desired)), tun, creds, "config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Annotations set by others on the pod template don't count.
+			current.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] = "2021-10-01T12:00:00Z"
+			if upToDate := deploymentUpToDate(current, desired); upToDate != tt.upToDate {
+				t.Errorf("deploymentUpToDate = %v, want %v", upToDate, tt.upToDate)
+			}
+		})
+	}
+}
@@ -5,104 +5,458 @@ import (
 	"fmt"
 	"github.com/cloudflare/cloudflare-go"
 	argonautv1 "github.com/laetho/argonaut/api/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"strings"
+	"time"
 )
 
-// Reconcile hostnames found in Argonaut instance with CloudFlare DNS
-func (r *ArgonautReconciler) ReconcileDNS(ctx context.Context, cfc *cloudflare.API, argonaut *argonautv1.Argonaut, tun *cloudflare.ArgoTunnel) error {
-	// Find all hostnames in ingress, reconcile records.
-	zone, err := r.ReconcileZone(ctx, cfc, argonaut)
-	if err != nil {
-		return err
+const (
+	// How soon hostnames that could not be published are retried.
+	dnsRetryInterval = time.Minute
+)
+
+// Reconcile hostnames found in Argonaut instance with CloudFlare DNS. Hostnames are grouped by
+// the zone they belong to, those without a zone in the account are reported in the Argonaut
+// status and left out. With dnsPolicy sync the records we claim for hostnames the Argonaut no
+// longer has are deleted, in the zones of its current hostnames and those it published before.
+// Cloudflare is left alone while nothing the records are made from changed, see
+// cloudflareResync.
+func (r *ArgonautReconciler) ReconcileDNS(ctx context.Context, cfc *cloudflare.API, argonaut *argonautv1.Argonaut, tun *cloudflare.ArgoTunnel, hostnames []string) error {
+	sum := r.dnsSum(argonaut, tun, hostnames)
+	if r.dnsSynced.fresh(string(argonaut.UID), sum) && dnsPublished(argonaut, hostnames) {
+		log.FromContext(ctx).V(1).Info("DNS records unchanged, not asking Cloudflare", "argonaut", argonaut.Name)
+		return nil
 	}
 
-	records, err := r.GetDNSRecords(ctx, cfc, zone)
-	if err != nil {
-		return err
+	desired := make(map[string]bool)
+	statuses := make([]argonautv1.ArgonautHostnameStatus, len(hostnames))
+	var zoneIDs []string
+	byZone := make(map[string][]int)
+	for i, hostname := range hostnames {
+		desired[strings.ToLower(hostname)] = true
+		statuses[i].Hostname = hostname
+		name, id, err := r.ZoneForHostname(ctx, cfc, hostname)
+		if err != nil {
+			return err
+		}
+		if len(id) == 0 {
+			statuses[i].Reason = reasonZoneNotFound
+			statuses[i].Message = errZoneNotFound
+			continue
+		}
+		statuses[i].Zone = name
+		if _, ok := byZone[id]; !ok {
+			zoneIDs = append(zoneIDs, id)
+			byZone[id] = nil
+		}
+		byZone[id] = append(byZone[id], i)
 	}
 
-	for _, ingress := range argonaut.Spec.Ingress {
-		exists, record := inDNSRecords(records, ingress.Hostname)
-		if exists {
-			// update
-			err := r.UpdateDNSRecord(ctx, cfc, ingress.Hostname, tun, record)
+	sync := dnsPolicy(argonaut) == argonautv1.DNSPolicySync
+	if sync {
+		// Zones we published in before may have no hostnames left.
+		for _, previous := range argonaut.Status.Hostnames {
+			if len(previous.Zone) == 0 {
+				continue
+			}
+			_, id, err := r.ZoneForHostname(ctx, cfc, previous.Zone)
 			if err != nil {
 				return err
 			}
-		} else {
-			// create
-			err := r.CreateDNSRecord(ctx, cfc, ingress.Hostname, zone, tun)
+			if _, ok := byZone[id]; len(id) != 0 && !ok {
+				zoneIDs = append(zoneIDs, id)
+				byZone[id] = nil
+			}
+		}
+	}
+
+	for _, zone := range zoneIDs {
+		registry, err := r.GetRegistryRecords(ctx, cfc, zone)
+		if err != nil {
+			return err
+		}
+		for _, i := range byZone[zone] {
+			records, err := r.GetDNSRecords(ctx, cfc, zone, hostnames[i])
 			if err != nil {
 				return err
 			}
+			if err := r.ReconcileDNSRecord(ctx, cfc, argonaut, tun, zone, records, registry, &statuses[i]); err != nil {
+				return err
+			}
+		}
+		if sync {
+			if err := r.DeleteStaleDNSRecords(ctx, cfc, argonaut, zone, registry, desired); err != nil {
+				return err
+			}
 		}
 	}
+
+	if len(statuses) == 0 {
+		statuses = nil
+	}
+	argonaut.Status.Hostnames = statuses
+	r.dnsSynced.store(string(argonaut.UID), sum)
 	return nil
 }
 
-// Fetch all DNS records for a Zone. We're only interestedin CNAME's for tunnels.
-func (r *ArgonautReconciler) GetDNSRecords(ctx context.Context, cfc *cloudflare.API, zoneid string) ([]cloudflare.DNSRecord, error) {
-	records, err := cfc.DNSRecords(ctx, zoneid, cloudflare.DNSRecord{Type: "CNAME"})
+// Points the CNAME of a hostname at the tunnel, creating it if the zone has none. Records claimed
+// by someone else are left alone, as are records nobody claims unless they already point at the
+// tunnel or the Argonaut adopts them. Other records at the hostname are handled according to
+// the conflictPolicy. Fills in the Target or Reason of the hostname status.
+func (r *ArgonautReconciler) ReconcileDNSRecord(ctx context.Context, cfc *cloudflare.API, argonaut *argonautv1.Argonaut, tun *cloudflare.ArgoTunnel, zone string, records []dnsRecord, registry []dnsRecord, status *argonautv1.ArgonautHostnameStatus) error {
+	hostname := status.Hostname
+	owner := r.argonautOwner(argonaut)
+	cnames, conflicts := splitDNSRecords(records)
+	exists, record := inDNSRecords(cnames, hostname)
+	claim, _, claimed := recordClaim(registry, hostname)
+
+	if claimed && claim != owner {
+		status.Reason = reasonRecordNotOwned
+		status.Message = fmt.Sprintf("%s: %s", errRecordOwnedElsewhere, claim)
+		r.Recorder.Eventf(argonaut, v1.EventTypeWarning, eventDNSRecordConflict, "DNS record of %s belongs to %s, leaving it alone", hostname, claim)
+		return nil
+	}
+	if !claimed && exists && record.Content != tunnelCNAME(tun) && dnsPolicy(argonaut) == argonautv1.DNSPolicyCreateOnly {
+		status.Reason = reasonRecordNotOwned
+		status.Message = errRecordNotUpdated
+		r.Recorder.Eventf(argonaut, v1.EventTypeWarning, eventDNSRecordConflict, "CNAME %s pointing at %s exists and dnsPolicy is create-only, leaving it alone", hostname, record.Content)
+		return nil
+	}
+	if !claimed && exists && record.Content != tunnelCNAME(tun) && argonaut.Spec.OwnershipPolicy != argonautv1.OwnershipPolicyAdopt {
+		status.Reason = reasonRecordNotOwned
+		status.Message = errRecordNotOwned
+		r.Recorder.Eventf(argonaut, v1.EventTypeWarning, eventDNSRecordConflict, "CNAME %s pointing at %s was not created by Argonaut, leaving it alone", hostname, record.Content)
+		return nil
+	}
+	if len(conflicts) != 0 {
+		resolved, err := r.ResolveDNSConflicts(ctx, cfc, argonaut, zone, conflicts, status)
+		if err != nil || !resolved {
+			return err
+		}
+	}
+	if !claimed {
+		// Claim first, a CNAME without claim would look like someone else's next time.
+		if err := r.CreateRegistryRecord(ctx, cfc, hostname, zone, owner); err != nil {
+			return err
+		}
+		if exists && record.Content != tunnelCNAME(tun) {
+			r.Recorder.Eventf(argonaut, v1.EventTypeNormal, eventDNSRecordAdopted, "Adopted CNAME %s pointing at %s", hostname, record.Content)
+		}
+	}
+
+	desired := desiredDNSRecord(argonaut, hostname, tun)
+	if exists {
+		if dnsRecordUpToDate(record, desired) {
+			status.Target = record.Content
+			return nil
+		}
+		if record.Content == desired.Content && dnsPolicy(argonaut) == argonautv1.DNSPolicyCreateOnly {
+			// Settings of existing records are not ours to change.
+			status.Target = record.Content
+			return nil
+		}
+		if err := r.UpdateDNSRecord(ctx, cfc, zone, record, desired); err != nil {
+			return err
+		}
+		if record.Content != desired.Content {
+			r.Recorder.Eventf(argonaut, v1.EventTypeNormal, eventDNSRecordUpdated, "Pointed CNAME %s at %s, was %s", hostname, desired.Content, record.Content)
+		} else {
+			r.Recorder.Eventf(argonaut, v1.EventTypeNormal, eventDNSRecordUpdated, "Updated settings of CNAME %s", hostname)
+		}
+		status.Target = desired.Content
+		return nil
+	}
+
+	err := r.CreateDNSRecord(ctx, cfc, zone, desired)
+	if isDNSRecordConflict(err) {
+		// Appeared since we looked, next time around the conflictPolicy applies.
+		status.Reason = reasonRecordConflict
+		status.Message = err.Error()
+		r.Recorder.Eventf(argonaut, v1.EventTypeWarning, eventDNSRecordConflict, "Another record exists for %s: %v", hostname, err)
+		return nil
+	}
 	if err != nil {
-		return records, err
+		return err
 	}
-	return records, nil
+	r.Recorder.Eventf(argonaut, v1.EventTypeNormal, eventDNSRecordCreated, "Created CNAME %s pointing at %s", hostname, desired.Content)
+	status.Target = desired.Content
+	return nil
+}
+
+// Handles records other than a CNAME at a hostname, which keep us from creating one. Report and
+// Skip leave the hostname out, Replace deletes the records. Returns true if the way is clear.
+func (r *ArgonautReconciler) ResolveDNSConflicts(ctx context.Context, cfc *cloudflare.API, argonaut *argonautv1.Argonaut, zone string, conflicts []dnsRecord, status *argonautv1.ArgonautHostnameStatus) (bool, error) {
+	var found []string
+	for _, record := range conflicts {
+		found = append(found, fmt.Sprintf("%s %s", record.Type, record.Content))
+	}
+
+	switch argonaut.Spec.ConflictPolicy {
+	case argonautv1.ConflictPolicyReplace:
+		for _, record := range conflicts {
+			if err := cfc.DeleteDNSRecord(ctx, zone, record.ID); err != nil {
+				return false, err
+			}
+			log.FromContext(ctx).Info("Deleted conflicting DNS Record", "host", record.Name, "type", record.Type, "content", record.Content)
+			r.Recorder.Eventf(argonaut, v1.EventTypeWarning, eventDNSRecordReplaced, "Deleted %s record %s pointing at %s to make way for the tunnel CNAME", record.Type, record.Name, record.Content)
+		}
+		return true, nil
+	case argonautv1.ConflictPolicySkip:
+		status.Reason = reasonRecordConflictSkipped
+		status.Message = fmt.Sprintf("%s: %s", errRecordConflict, strings.Join(found, ", "))
+		log.FromContext(ctx).Info("skipping hostname with conflicting DNS records", "host", status.Hostname, "records", found)
+		return false, nil
+	default:
+		status.Reason = reasonRecordConflict
+		status.Message = fmt.Sprintf("%s: %s", errRecordConflict, strings.Join(found, ", "))
+		r.Recorder.Eventf(argonaut, v1.EventTypeWarning, eventDNSRecordConflict, "%s has other records, leaving it alone: %s", status.Hostname, strings.Join(found, ", "))
+		return false, nil
+	}
+}
+
+// Splits the records at a hostname into CNAMEs and the others, which can't live next to one.
+func splitDNSRecords(records []dnsRecord) ([]dnsRecord, []dnsRecord) {
+	var cnames, others []dnsRecord
+	for _, record := range records {
+		if record.Type == "CNAME" {
+			cnames = append(cnames, record)
+		} else {
+			others = append(others, record)
+		}
+	}
+	return cnames, others
+}
+
+// Deletes the records the Argonaut claims in a zone for hostnames it no longer has, along with
+// the claims themselves.
+func (r *ArgonautReconciler) DeleteStaleDNSRecords(ctx context.Context, cfc *cloudflare.API, argonaut *argonautv1.Argonaut, zone string, registry []dnsRecord, desired map[string]bool) error {
+	owner := r.argonautOwner(argonaut)
+	for _, claim := range registry {
+		if claimOwner, ok := parseRegistryContent(claim.Content); !ok || claimOwner != owner {
+			continue
+		}
+		hostname := registryHostname(claim.Name)
+		if desired[hostname] {
+			continue
+		}
+		records, err := listDNSRecords(ctx, cfc, zone, "CNAME", hostname)
+		if err != nil {
+			return err
+		}
+		if exists, record := inDNSRecords(records, hostname); exists {
+			if err := cfc.DeleteDNSRecord(ctx, zone, record.ID); err != nil {
+				return err
+			}
+			log.FromContext(ctx).Info("Deleted stale DNS Record", "host", record.Name, "cname", record.Content)
+			r.Recorder.Eventf(argonaut, v1.EventTypeNormal, eventDNSRecordDeleted, "Deleted CNAME %s pointing at %s, the hostname was removed", record.Name, record.Content)
+		}
+		if err := cfc.DeleteDNSRecord(ctx, zone, claim.ID); err != nil {
+			return err
+		}
+		log.FromContext(ctx).Info("Deleted registry record", "host", hostname)
+	}
+	return nil
+}
+
+// The dnsPolicy of an Argonaut, sync if not set.
+func dnsPolicy(argonaut *argonautv1.Argonaut) argonautv1.DNSPolicy {
+	if len(argonaut.Spec.DNSPolicy) == 0 {
+		return argonautv1.DNSPolicySync
+	}
+	return argonaut.Spec.DNSPolicy
+}
+
+// Sets DNSReady from the hostnames in the Argonaut status. Returns false if any of them is not
+// published.
+func setDNSCondition(argonaut *argonautv1.Argonaut) bool {
+	var reason string
+	var unpublished []string
+	for _, status := range argonaut.Status.Hostnames {
+		if len(status.Reason) == 0 || status.Reason == reasonRecordConflictSkipped {
+			continue
+		}
+		if len(reason) == 0 {
+			reason = status.Reason
+		}
+		unpublished = append(unpublished, status.Hostname)
+	}
+	if len(unpublished) == 0 {
+		setCondition(&argonaut.Status.Conditions, argonaut.Generation, argonautv1.ConditionDNSReady, metav1.ConditionTrue, reasonReconciled, "")
+		return true
+	}
+	message := fmt.Sprintf("hostnames not published, see status.hostnames: %s", strings.Join(unpublished, ", "))
+	setCondition(&argonaut.Status.Conditions, argonaut.Generation, argonautv1.ConditionDNSReady, metav1.ConditionFalse, reason, message)
+	return false
+}
+
+// Fetch the DNS records of every type at a hostname. Besides our CNAME there shouldn't be any.
+func (r *ArgonautReconciler) GetDNSRecords(ctx context.Context, cfc *cloudflare.API, zoneid string, hostname string) ([]dnsRecord, error) {
+	return listDNSRecords(ctx, cfc, zoneid, "", hostname)
+}
+
+// The CNAME a hostname should have, with the DNS settings of the first rule for it that has
+// some. Comment and tags are only set if the rule sets them.
+func desiredDNSRecord(argonaut *argonautv1.Argonaut, hostname string, tun *cloudflare.ArgoTunnel) dnsRecord {
+	proxied := true
+	record := dnsRecord{
+		DNSRecord: cloudflare.DNSRecord{
+			Type:    "CNAME",
+			Name:    hostname,
+			Content: tunnelCNAME(tun),
+			Proxied: &proxied,
+			TTL:     1,
+		},
+	}
+	for _, rule := range argonaut.Spec.Ingress {
+		if rule.Hostname != hostname || rule.DNS == nil {
+			continue
+		}
+		if rule.DNS.Proxied != nil {
+			proxied = *rule.DNS.Proxied
+		}
+		if !proxied && rule.DNS.TTL != 0 {
+			record.TTL = rule.DNS.TTL
+		}
+		record.Comment = rule.DNS.Comment
+		record.Tags = rule.DNS.Tags
+		break
+	}
+	return record
+}
+
+// Checks if an existing record matches the desired one in everything we manage.
+func dnsRecordUpToDate(existing dnsRecord, desired dnsRecord) bool {
+	if existing.Content != desired.Content || existing.TTL != desired.TTL {
+		return false
+	}
+	if (existing.Proxied != nil && *existing.Proxied) != *desired.Proxied {
+		return false
+	}
+	if len(desired.Comment) != 0 && existing.Comment != desired.Comment {
+		return false
+	}
+	if len(desired.Tags) != 0 && !sameStrings(existing.Tags, desired.Tags) {
+		return false
+	}
+	return true
+}
+
+// Checks if two slices hold the same strings, in any order.
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int)
+	for _, s := range a {
+		counts[s]++
+	}
+	for _, s := range b {
+		counts[s]--
+		if counts[s] < 0 {
+			return false
+		}
+	}
+	return true
 }
 
 // Create a Cloudflare DNS record.
-func (r *ArgonautReconciler) CreateDNSRecord(ctx context.Context, cfc *cloudflare.API, name string, zoneid string, tun *cloudflare.ArgoTunnel) error {
-	record := cloudflare.DNSRecord{
-		Type:      "CNAME",
-		Name:      name,
-		Content:   tun.ID + ".cfargotunnel.com",
-		Proxiable: true,
-		Proxied:   new(bool),
-		TTL:       1,
-		Locked:    false,
-		ZoneID:    zoneid,
-		Data:      nil,
-		Meta:      nil,
-		Priority:  nil,
-	}
-	res, err := cfc.CreateDNSRecord(ctx, zoneid, record)
-	if err != nil {
-		fmt.Println(res)
+func (r *ArgonautReconciler) CreateDNSRecord(ctx context.Context, cfc *cloudflare.API, zoneid string, record dnsRecord) error {
+	if err := createDNSRecord(cfc, zoneid, record); err != nil {
 		return err
 	}
+	log.FromContext(ctx).Info("Created DNS Record", "host", record.Name, "cname", record.Content, "proxied", *record.Proxied)
 	return nil
 }
 
-func (r *ArgonautReconciler) UpdateDNSRecord(ctx context.Context, cfc *cloudflare.API, name string, tun *cloudflare.ArgoTunnel, record cloudflare.DNSRecord) error {
-	update := cloudflare.DNSRecord{
-		ID:        record.ID,
-		Type:      "CNAME",
-		Name:      name,
-		Content:   tun.ID + ".cfargotunnel.com",
-		Proxiable: true,
-		Proxied:   record.Proxied,
-		TTL:       1,
-		Locked:    false,
-		ZoneID:    record.ZoneID,
-		ZoneName:  record.ZoneName,
-		Data:      record.Data,
-		Meta:      record.Meta,
-		Priority:  record.Priority,
-	}
-
-	err := cfc.UpdateDNSRecord(ctx, record.ZoneID, record.ID, update)
-	if err != nil {
+// Brings an existing Cloudflare DNS record in line with the desired one.
+func (r *ArgonautReconciler) UpdateDNSRecord(ctx context.Context, cfc *cloudflare.API, zoneid string, existing dnsRecord, desired dnsRecord) error {
+	if err := patchDNSRecord(cfc, zoneid, existing.ID, desired); err != nil {
 		return err
 	}
-	log.FromContext(ctx).Info("Updated DNS Record", "host", name, "cname", record.Content)
+	log.FromContext(ctx).Info("Updated DNS Record", "host", desired.Name, "cname", desired.Content, "proxied", *desired.Proxied)
 	return nil
 }
 
-// Checks if a hostname is found in a slice of cloudflare.DNSRecord items.
-func inDNSRecords(records []cloudflare.DNSRecord, item string) (bool, cloudflare.DNSRecord) {
+// Delete the CNAME records for the Argonaut's hostnames that point at the given tunnel, along
+// with the TXT records claiming them. Records pointing elsewhere or claimed by someone else are
+// not ours and are left alone.
+func (r *ArgonautReconciler) DeleteDNSRecords(ctx context.Context, cfc *cloudflare.API, argonaut *argonautv1.Argonaut, tun *cloudflare.ArgoTunnel) error {
+	r.dnsSynced.forget(string(argonaut.UID))
+	owner := r.argonautOwner(argonaut)
+	for _, hostname := range argonautHostnames(argonaut) {
+		_, zone, err := r.ZoneForHostname(ctx, cfc, hostname)
+		if err != nil {
+			return err
+		}
+		if len(zone) == 0 {
+			// Never published, nothing to delete.
+			continue
+		}
+
+		claims, err := listDNSRecords(ctx, cfc, zone, "TXT", registryRecordName(hostname))
+		if err != nil {
+			return err
+		}
+		claim, registryRecord, claimed := recordClaim(claims, hostname)
+		if claimed && claim != owner {
+			log.FromContext(ctx).Info("DNS record belongs to someone else, leaving it", "host", hostname, "owner", claim.String())
+			continue
+		}
+
+		records, err := listDNSRecords(ctx, cfc, zone, "CNAME", hostname)
+		if err != nil {
+			return err
+		}
+		remaining := 0
+		for _, record := range records {
+			if record.Content != tunnelCNAME(tun) {
+				remaining++
+				continue
+			}
+			if err := cfc.DeleteDNSRecord(ctx, zone, record.ID); err != nil {
+				return err
+			}
+			log.FromContext(ctx).Info("Deleted DNS Record", "host", record.Name, "cname", record.Content)
+			r.Recorder.Eventf(argonaut, v1.EventTypeNormal, eventDNSRecordDeleted, "Deleted CNAME %s pointing at %s", record.Name, record.Content)
+		}
+		// Our claim goes once the record it covers is gone.
+		if claimed && remaining == 0 {
+			if err := cfc.DeleteDNSRecord(ctx, zone, registryRecord.ID); err != nil {
+				return err
+			}
+			log.FromContext(ctx).Info("Deleted registry record", "host", hostname)
+		}
+	}
+	return nil
+}
+
+// Hostnames of an Argonaut, once each. Several rules may share a hostname with different paths.
+func argonautHostnames(argonaut *argonautv1.Argonaut) []string {
+	seen := make(map[string]bool)
+	var hostnames []string
+	for _, ingress := range argonaut.Spec.Ingress {
+		if len(ingress.Hostname) == 0 || seen[ingress.Hostname] {
+			continue
+		}
+		seen[ingress.Hostname] = true
+		hostnames = append(hostnames, ingress.Hostname)
+	}
+	return hostnames
+}
+
+// The CNAME target for hostnames routed through an Argo Tunnel.
+func tunnelCNAME(tun *cloudflare.ArgoTunnel) string {
+	return tun.ID + ".cfargotunnel.com"
+}
+
+// Checks if a hostname is found in a slice of DNS records.
+func inDNSRecords(records []dnsRecord, item string) (bool, dnsRecord) {
 	for _, record := range records {
-		if record.Name == item {
+		if strings.EqualFold(record.Name, item) {
 			return true, record
 		}
 	}
-	return false, cloudflare.DNSRecord{}
+	return false, dnsRecord{}
 }
@@ -0,0 +1,184 @@
+package controllers
+
+import (
+	"github.com/cloudflare/cloudflare-go"
+	argonautv1 "github.com/laetho/argonaut/api/v1beta1"
+	"reflect"
+	"testing"
+)
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestDesiredDNSRecord(t *testing.T) {
+	tun := &cloudflare.ArgoTunnel{ID: "6ff42ae2-765d-4adf-8112-31c55c1551ef"}
+	cname := tunnelCNAME(tun)
+	tests := []struct {
+		name    string
+		rules   []argonautv1.ArgonautIngressRule
+		proxied bool
+		ttl     int
+		comment string
+		tags    []string
+	}{
+		{
+			name:    "defaults",
+			rules:   []argonautv1.ArgonautIngressRule{{Hostname: "app.example.com"}},
+			proxied: true,
+			ttl:     1,
+		},
+		{
+			name: "proxied ignores TTL",
+			rules: []argonautv1.ArgonautIngressRule{
+				{Hostname: "app.example.com", DNS: &argonautv1.ArgonautDNSOptions{TTL: 300}},
+			},
+			proxied: true,
+			ttl:     1,
+		},
+		{
+			name: "not proxied",
+			rules: []argonautv1.ArgonautIngressRule{
+				{Hostname: "app.example.com", DNS: &argonautv1.ArgonautDNSOptions{Proxied: boolPtr(false)}},
+			},
+			proxied: false,
+			ttl:     1,
+		},
+		{
+			name: "not proxied with TTL",
+			rules: []argonautv1.ArgonautIngressRule{
+				{Hostname: "app.example.com", DNS: &argonautv1.ArgonautDNSOptions{Proxied: boolPtr(false), TTL: 300}},
+			},
+			proxied: false,
+			ttl:     300,
+		},
+		{
+			name: "comment and tags",
+			rules: []argonautv1.ArgonautIngressRule{
+				{Hostname: "app.example.com", DNS: &argonautv1.ArgonautDNSOptions{Comment: "web", Tags: []string{"team:web"}}},
+			},
+			proxied: true,
+			ttl:     1,
+			comment: "web",
+			tags:    []string{"team:web"},
+		},
+		{
+			name: "first rule with options",
+			rules: []argonautv1.ArgonautIngressRule{
+				{Hostname: "other.example.com", DNS: &argonautv1.ArgonautDNSOptions{Comment: "other"}},
+				{Hostname: "app.example.com", Path: "/api"},
+				{Hostname: "app.example.com", DNS: &argonautv1.ArgonautDNSOptions{Comment: "first"}},
+				{Hostname: "app.example.com", DNS: &argonautv1.ArgonautDNSOptions{Comment: "second"}},
+			},
+			proxied: true,
+			ttl:     1,
+			comment: "first",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			argonaut := &argonautv1.Argonaut{Spec: argonautv1.ArgonautSpec{Ingress: tt.rules}}
+			record := desiredDNSRecord(argonaut, "app.example.com", tun)
+			if record.Type != "CNAME" || record.Name != "app.example.com" || record.Content != cname {
+				t.Errorf("record is %s %s %s, want CNAME app.example.com %s", record.Type, record.Name, record.Content, cname)
+			}
+			if record.Proxied == nil || *record.Proxied != tt.proxied {
+				t.Errorf("proxied is %v, want %v", record.Proxied, tt.proxied)
+			}
+			if record.TTL != tt.ttl {
+				t.Errorf("TTL is %d, want %d", record.TTL, tt.ttl)
+			}
+			if record.Comment != tt.comment || !reflect.DeepEqual(record.Tags, tt.tags) {
+				t.Errorf("comment and tags are %q %v, want %q %v", record.Comment, record.Tags, tt.comment, tt.tags)
+			}
+		})
+	}
+}
+
+func TestDNSRecordUpToDate(t *testing.T) {
+	record := func(content string, proxied *bool, ttl int, comment string, tags ...string) dnsRecord {
+		return dnsRecord{
+			DNSRecord: cloudflare.DNSRecord{Type: "CNAME", Name: "app.example.com", Content: content, Proxied: proxied, TTL: ttl},
+			Comment:   comment,
+			Tags:      tags,
+		}
+	}
+	tests := []struct {
+		name     string
+		existing dnsRecord
+		desired  dnsRecord
+		upToDate bool
+	}{
+		{
+			name:     "same",
+			existing: record("a.cfargotunnel.com", boolPtr(true), 1, ""),
+			desired:  record("a.cfargotunnel.com", boolPtr(true), 1, ""),
+			upToDate: true,
+		},
+		{
+			name:     "other tunnel",
+			existing: record("b.cfargotunnel.com", boolPtr(true), 1, ""),
+			desired:  record("a.cfargotunnel.com", boolPtr(true), 1, ""),
+		},
+		{
+			name:     "not proxied",
+			existing: record("a.cfargotunnel.com", boolPtr(false), 1, ""),
+			desired:  record("a.cfargotunnel.com", boolPtr(true), 1, ""),
+		},
+		{
+			name:     "proxied unset",
+			existing: record("a.cfargotunnel.com", nil, 1, ""),
+			desired:  record("a.cfargotunnel.com", boolPtr(true), 1, ""),
+		},
+		{
+			name:     "proxied unset and not wanted",
+			existing: record("a.cfargotunnel.com", nil, 1, ""),
+			desired:  record("a.cfargotunnel.com", boolPtr(false), 1, ""),
+			upToDate: true,
+		},
+		{
+			name:     "other TTL",
+			existing: record("a.cfargotunnel.com", boolPtr(false), 1, ""),
+			desired:  record("a.cfargotunnel.com", boolPtr(false), 300, ""),
+		},
+		{
+			name:     "comment not managed",
+			existing: record("a.cfargotunnel.com", boolPtr(true), 1, "set by hand", "env:prod"),
+			desired:  record("a.cfargotunnel.com", boolPtr(true), 1, ""),
+			upToDate: true,
+		},
+		{
+			name:     "other comment",
+			existing: record("a.cfargotunnel.com", boolPtr(true), 1, "set by hand"),
+			desired:  record("a.cfargotunnel.com", boolPtr(true), 1, "web"),
+		},
+		{
+			name:     "tags in another order",
+			existing: record("a.cfargotunnel.com", boolPtr(true), 1, "web", "env:prod", "team:web"),
+			desired:  record("a.cfargotunnel.com", boolPtr(true), 1, "web", "team:web", "env:prod"),
+			upToDate: true,
+		},
+		{
+			name:     "tag missing",
+			existing: record("a.cfargotunnel.com", boolPtr(true), 1, "", "team:web"),
+			desired:  record("a.cfargotunnel.com", boolPtr(true), 1, "", "team:web", "env:prod"),
+		},
+		{
+			name:     "tag too many",
+			existing: record("a.cfargotunnel.com", boolPtr(true), 1, "", "team:web", "env:prod"),
+			desired:  record("a.cfargotunnel.com", boolPtr(true), 1, "", "team:web"),
+		},
+		{
+			name:     "duplicate tags",
+			existing: record("a.cfargotunnel.com", boolPtr(true), 1, "", "team:web", "team:web"),
+			desired:  record("a.cfargotunnel.com", boolPtr(true), 1, "", "team:web", "env:prod"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if upToDate := dnsRecordUpToDate(tt.existing, tt.desired); upToDate != tt.upToDate {
+				t.Errorf("dnsRecordUpToDate = %v, want %v", upToDate, tt.upToDate)
+			}
+		})
+	}
+}
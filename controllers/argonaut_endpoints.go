@@ -0,0 +1,210 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	argonautv1 "github.com/laetho/argonaut/api/v1beta1"
+	"hash/fnv"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sort"
+)
+
+// cloudflared takes a single origin per rule. Rules with an endpointsSelector therefore route
+// through a headless Service without selector next to the Argonaut, whose Endpoints we fill with
+// the ready addresses the rule selects. cloudflared resolves the Service name to all of them, and
+// pods coming and going don't touch its config.
+const (
+	endpointsComponent = "endpoints"
+	endpointsPortName  = "origin"
+)
+
+// The ready addresses an endpointsSelector rule selects, and the port they serve it on.
+type ruleEndpoints struct {
+	Addresses []v1.EndpointAddress
+	Port      int32
+
+	// Endpoints left out for lack of a ServiceGrant, as namespace/name.
+	Denied []string
+
+	// Why no address was found.
+	Warning string
+}
+
+// Whether a rule routes through an endpointsSelector, following the precedence of
+// ResolveIngressRule.
+func endpointsRule(ingress argonautv1.ArgonautIngressRule) bool {
+	switch ingress.Protocol {
+	case argonautv1.ProtocolHTTPStatus, argonautv1.ProtocolHelloWorld, argonautv1.ProtocolUnix:
+		return false
+	}
+	return ingress.ServiceRef == nil && selectorSet(ingress.EndpointsSelector)
+}
+
+// Name of the headless Service carrying the addresses of an endpointsSelector rule.
+func endpointsServiceName(argonaut *argonautv1.Argonaut, ingress argonautv1.ArgonautIngressRule) string {
+	h := fnv.New32a()
+	h.Write([]byte(ingress.Hostname + "\x00" + ingress.Path))
+	suffix := fmt.Sprintf("-ep-%08x", h.Sum32())
+	name := argonaut.Name
+	if len(name)+len(suffix) > 63 {
+		name = name[:63-len(suffix)]
+	}
+	return name + suffix
+}
+
+// Labels of the headless Services and Endpoints managed for an Argonaut.
+func endpointsServiceLabels(argonaut *argonautv1.Argonaut) map[string]string {
+	return map[string]string{
+		"argonaut":                     argonaut.Name,
+		"app.kubernetes.io/component":  endpointsComponent,
+		"app.kubernetes.io/managed-by": "argonaut",
+	}
+}
+
+// Collects the ready addresses of the Endpoints an endpointsSelector rule selects. Only addresses
+// serving the port of the first matching subset are kept, a Service has a single target port.
+func (r *ArgonautReconciler) selectRuleEndpoints(ctx context.Context, argonaut *argonautv1.Argonaut, ingress argonautv1.ArgonautIngressRule) ruleEndpoints {
+	var selected ruleEndpoints
+	eps, denied, err := r.SelectEndpoints(ctx, argonaut, ingress)
+	if err != nil {
+		log.FromContext(ctx).Info("Found no Endpoints matching selector", "selector", ingress.EndpointsSelector, "error", err.Error())
+	}
+	for _, endpoints := range denied {
+		selected.Denied = append(selected.Denied, endpoints.Namespace+"/"+endpoints.Name)
+	}
+
+	// Keep the pick of port stable whatever order the cache lists Endpoints in.
+	sort.Slice(eps, func(i, j int) bool {
+		return eps[i].Namespace+"/"+eps[i].Name < eps[j].Namespace+"/"+eps[j].Name
+	})
+	for i := range eps {
+		for _, subset := range eps[i].Subsets {
+			if len(subset.Addresses) == 0 {
+				continue
+			}
+			p, warning := endpointPort(&eps[i], subset.Ports, ingress.Port)
+			if p == nil {
+				selected.Warning = warning
+				continue
+			}
+			if selected.Port == 0 {
+				selected.Port = p.Port
+			}
+			if p.Port == selected.Port {
+				selected.Addresses = append(selected.Addresses, subset.Addresses...)
+			}
+		}
+	}
+	sort.Slice(selected.Addresses, func(i, j int) bool {
+		return selected.Addresses[i].IP < selected.Addresses[j].IP
+	})
+	if len(selected.Addresses) == 0 && len(selected.Warning) == 0 {
+		selected.Warning = "endpointsSelector matches no ready address"
+	}
+	return selected
+}
+
+// Resolves a rule routing straight to pods through an endpointsSelector to the headless Service
+// carrying their addresses.
+func (r *ArgonautReconciler) resolveEndpoints(ctx context.Context, argonaut *argonautv1.Argonaut, ingress argonautv1.ArgonautIngressRule) ruleBackend {
+	selected := r.selectRuleEndpoints(ctx, argonaut, ingress)
+	backend := ruleBackend{Denied: selected.Denied}
+	if len(selected.Addresses) == 0 {
+		backend.Warning = selected.Warning
+		return backend
+	}
+	scheme := ingress.Protocol
+	if len(scheme) == 0 {
+		scheme = argonautv1.ProtocolHTTP
+	}
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: endpointsServiceName(argonaut, ingress), Namespace: argonaut.Namespace}}
+	backend.Service = fmt.Sprintf("%s://%s:%d", scheme, r.serviceHostname(service), selected.Port)
+	return backend
+}
+
+// Keeps a headless Service with matching Endpoints for every endpointsSelector rule of an
+// Argonaut, and removes those of rules that are gone.
+func (r *ArgonautReconciler) ReconcileEndpointsServices(ctx context.Context, argonaut *argonautv1.Argonaut) error {
+	desired := make(map[string]bool)
+	for _, ingress := range argonaut.Spec.Ingress {
+		if !endpointsRule(ingress) {
+			continue
+		}
+		name := endpointsServiceName(argonaut, ingress)
+		if desired[name] {
+			continue
+		}
+		desired[name] = true
+		if err := r.reconcileEndpointsService(ctx, argonaut, name, r.selectRuleEndpoints(ctx, argonaut, ingress)); err != nil {
+			return err
+		}
+	}
+
+	var services v1.ServiceList
+	if err := r.List(ctx, &services, client.InNamespace(argonaut.Namespace), client.MatchingLabels(endpointsServiceLabels(argonaut))); err != nil {
+		return err
+	}
+	for i := range services.Items {
+		service := &services.Items[i]
+		if desired[service.Name] || !metav1.IsControlledBy(service, argonaut) {
+			continue
+		}
+		if err := r.Delete(ctx, service); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		endpoints := &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: service.Name, Namespace: service.Namespace}}
+		if err := r.Delete(ctx, endpoints); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		log.FromContext(ctx).Info("Deleted endpoints Service", "service", service.Name, "namespace", service.Namespace)
+	}
+	return nil
+}
+
+// Creates or updates the headless Service and Endpoints of a single rule.
+func (r *ArgonautReconciler) reconcileEndpointsService(ctx context.Context, argonaut *argonautv1.Argonaut, name string, selected ruleEndpoints) error {
+	labels := endpointsServiceLabels(argonaut)
+
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: argonaut.Namespace}}
+	if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, service, func() error {
+		service.Labels = labels
+		service.Spec.ClusterIP = v1.ClusterIPNone
+		service.Spec.Selector = nil
+		service.Spec.Ports = nil
+		if selected.Port != 0 {
+			service.Spec.Ports = []v1.ServicePort{{
+				Name:       endpointsPortName,
+				Protocol:   v1.ProtocolTCP,
+				Port:       selected.Port,
+				TargetPort: intstr.FromInt(int(selected.Port)),
+			}}
+		}
+		return controllerutil.SetControllerReference(argonaut, service, r.Scheme)
+	}); err != nil {
+		return err
+	}
+
+	endpoints := &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: argonaut.Namespace}}
+	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, endpoints, func() error {
+		endpoints.Labels = labels
+		endpoints.Subsets = nil
+		if len(selected.Addresses) != 0 {
+			endpoints.Subsets = []v1.EndpointSubset{{
+				Addresses: selected.Addresses,
+				Ports: []v1.EndpointPort{{
+					Name:     endpointsPortName,
+					Protocol: v1.ProtocolTCP,
+					Port:     selected.Port,
+				}},
+			}}
+		}
+		return controllerutil.SetControllerReference(argonaut, endpoints, r.Scheme)
+	})
+	return err
+}
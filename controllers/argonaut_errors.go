@@ -1,5 +1,51 @@
 package controllers
 
+import (
+	"github.com/cloudflare/cloudflare-go"
+	"net/http"
+)
+
 const (
-	errZoneNotFound = "Zone Information not found"
+	errZoneNotFound             = "No zone in the Cloudflare account matches the hostname"
+	errRecordNotOwned           = "A DNS record Argonaut did not create exists for the hostname, set ownershipPolicy Adopt to take it over"
+	errRecordOwnedElsewhere     = "The DNS record of the hostname is claimed by"
+	errRecordConflict           = "Records that can't live next to a CNAME exist for the hostname"
+	errRecordNotUpdated         = "A DNS record Argonaut did not create exists for the hostname and dnsPolicy create-only does not update it"
+	errTunnelCredentialsMissing = "Argo Tunnel exists but its credentials are not in the tunnel Secret"
+	errTunnelSecretNotFound     = "Referenced tunnel Secret not found"
+	errTunnelSecretInvalid      = "Referenced tunnel Secret has no tunnel.json, credentials.json or token"
+	errTunnelNotFound           = "Argo Tunnel from the referenced tunnel Secret does not exist"
+	errArgoTunnelNotFound       = "ArgoTunnel this Argonaut is attached to no longer exists"
+	errArgoTunnelConflict       = "Argonaut runs its own tunnel but an ArgoTunnel by the same name exists"
 )
+
+// Checks if an error from the Cloudflare API is a 404.
+func isCloudflareNotFound(err error) bool {
+	if apiErr, ok := err.(*cloudflare.APIRequestError); ok {
+		return apiErr.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// Checks if an error from the Cloudflare API is a 401 or 403.
+func isCloudflareAuthError(err error) bool {
+	if apiErr, ok := err.(*cloudflare.APIRequestError); ok {
+		return apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden
+	}
+	return false
+}
+
+// Checks if the Cloudflare API refused to create a DNS record because another record exists for
+// the name.
+func isDNSRecordConflict(err error) bool {
+	if apiErr, ok := err.(*cloudflare.APIRequestError); ok {
+		for _, code := range apiErr.InternalErrorCodes() {
+			// 81053: an A, AAAA or CNAME record with that host already exists.
+			// 81057: the record already exists.
+			if code == 81053 || code == 81057 {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+package controllers
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Event reasons recorded on Argonaut and ArgoTunnel objects.
+const (
+	eventTunnelCreated        = "TunnelCreated"
+	eventTunnelAdopted        = "TunnelAdopted"
+	eventTunnelSwitched       = "TunnelSwitched"
+	eventTunnelDeleted        = "TunnelDeleted"
+	eventDNSRecordCreated     = "DNSRecordCreated"
+	eventDNSRecordUpdated     = "DNSRecordUpdated"
+	eventDNSRecordDeleted     = "DNSRecordDeleted"
+	eventDNSRecordConflict    = "DNSRecordConflict"
+	eventDNSRecordAdopted     = "DNSRecordAdopted"
+	eventDNSRecordReplaced    = "DNSRecordReplaced"
+	eventConfigUpdated        = "ConfigUpdated"
+	eventDeploymentCreated    = "DeploymentCreated"
+	eventDeploymentRolled     = "DeploymentRolled"
+	eventCloudflareAuthFailed = "CloudflareAuthFailed"
+)
+
+// Records a Warning event if the Cloudflare API refused our credentials.
+func (r *ArgonautReconciler) recordCloudflareAuthError(obj runtime.Object, err error) {
+	if isCloudflareAuthError(err) {
+		r.Recorder.Event(obj, v1.EventTypeWarning, eventCloudflareAuthFailed, err.Error())
+	}
+}
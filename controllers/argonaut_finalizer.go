@@ -0,0 +1,247 @@
+package controllers
+
+import (
+	"context"
+	"github.com/cloudflare/cloudflare-go"
+	argonautv1 "github.com/laetho/argonaut/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"time"
+)
+
+const (
+	// Finalizer added to every Argonaut and ArgoTunnel so Cloudflare resources can be cleaned up
+	// before removal.
+	argonautFinalizer = "argonaut.metalabs.no/finalizer"
+)
+
+// Makes sure the object carries our finalizer. Returns true if the object was updated.
+func (r *ArgonautReconciler) EnsureFinalizer(ctx context.Context, obj client.Object) (bool, error) {
+	if controllerutil.ContainsFinalizer(obj, argonautFinalizer) {
+		return false, nil
+	}
+	controllerutil.AddFinalizer(obj, argonautFinalizer)
+	if err := r.Update(ctx, obj); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Tears down everything created for an Argonaut that is being deleted, and releases the
+// finalizer once done. Cloudflare resources are left alone if the DeletionPolicy is Orphan.
+func (r *ArgonautReconciler) FinalizeArgonaut(ctx context.Context, argonaut *argonautv1.Argonaut) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(argonaut, argonautFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	if len(argonaut.Status.ArgoTunnel) != 0 {
+		// The tunnel belongs to the ArgoTunnel, we only take our DNS records along.
+		if err := r.FinalizeSharedArgonaut(ctx, argonaut); err != nil {
+			return ctrl.Result{}, err
+		}
+	} else {
+		done, err := r.FinalizeTunnelHost(ctx, argonautTunnelHost(argonaut))
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if !done {
+			return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
+		}
+	}
+
+	controllerutil.RemoveFinalizer(argonaut, argonautFinalizer)
+	if err := r.Update(ctx, argonaut); err != nil {
+		return ctrl.Result{}, err
+	}
+	log.FromContext(ctx).Info("finalized Argonaut", "name", argonaut.Name)
+	return ctrl.Result{}, nil
+}
+
+// Removes the DNS records of an Argonaut using a shared ArgoTunnel.
+func (r *ArgonautReconciler) FinalizeSharedArgonaut(ctx context.Context, argonaut *argonautv1.Argonaut) error {
+	if argonaut.Spec.DeletionPolicy == argonautv1.DeletionPolicyOrphan || len(argonaut.Status.TunnelId) == 0 {
+		return nil
+	}
+	cfc, err := r.CloudflareLogin(ctx, argonaut.Spec.CFAuthSecret)
+	if errors.IsNotFound(err) {
+		log.FromContext(ctx).Error(err, "Cloudflare credentials gone, leaving DNS records behind", "name", argonaut.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return r.DeleteDNSRecords(ctx, cfc, argonaut, &cloudflare.ArgoTunnel{ID: argonaut.Status.TunnelId})
+}
+
+// Tears down the cloudflared Deployment, Argo Tunnel and DNS records of a tunnel that is being
+// deleted. Cloudflare resources are left alone if the DeletionPolicy is Orphan. Returns true
+// once done, false while waiting for the Deployment to terminate.
+func (r *ArgonautReconciler) FinalizeTunnelHost(ctx context.Context, host *tunnelHost) (bool, error) {
+	// cloudflared must be gone before the tunnel can be deleted, or it just reconnects.
+	gone, err := r.DeleteArgonautDeployment(ctx, host)
+	if err != nil {
+		return false, err
+	}
+	if !gone {
+		log.FromContext(ctx).Info("waiting for Argonaut Deployment to terminate", "name", host.Name)
+		return false, nil
+	}
+
+	if host.DeletionPolicy == argonautv1.DeletionPolicyOrphan {
+		log.FromContext(ctx).Info("orphaning Argo Tunnel and DNS records", "tunnel", host.TunnelName)
+		// The orphaned tunnel is useless without its credentials, keep them from being collected.
+		if creds, err := r.GetArgonautTunnelCredentials(ctx, host); err == nil && creds.Managed {
+			if err := r.releaseObject(ctx, host, &v1.Secret{}, creds.SecretName); err != nil {
+				return false, err
+			}
+		}
+	} else {
+		cfc, err := r.CloudflareLogin(ctx, host.CFAuthSecret)
+		if errors.IsNotFound(err) {
+			// Usually the namespace is going away with the credentials in it. Blocking here
+			// would hang the namespace deletion, so we give up on the Cloudflare side.
+			log.FromContext(ctx).Error(err, "Cloudflare credentials gone, leaving tunnel and DNS records behind", "tunnel", host.TunnelName)
+		} else if err != nil {
+			return false, err
+		} else if err := r.TeardownArgoTunnel(ctx, cfc, host); err != nil {
+			log.FromContext(ctx).Error(err, "unable to tear down Argo Tunnel", "tunnel", host.TunnelName)
+			return false, err
+		}
+		// Only remove Secrets we wrote, a referenced argoTunnelSecret belongs to the user.
+		if creds, err := r.GetArgonautTunnelCredentials(ctx, host); err == nil && creds.Managed {
+			if err := r.deleteIfExists(ctx, &v1.Secret{}, creds.SecretName, host.Namespace); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if err := r.deleteIfExists(ctx, &v1.ConfigMap{}, host.Name, host.Namespace); err != nil {
+		return false, err
+	}
+	if err := r.deleteIfExists(ctx, &v1.Service{}, metricsServiceName(host), host.Namespace); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Removes the DNS records pointing at the tunnel, cleans up lingering connections and deletes
+// the Argo Tunnel itself. Covers both tunnels if we're caught in the middle of a rotation.
+func (r *ArgonautReconciler) TeardownArgoTunnel(ctx context.Context, cfc *cloudflare.API, host *tunnelHost) error {
+	ids := []string{host.Status.TunnelId}
+	if len(host.Status.PreviousTunnelId) != 0 {
+		ids = append(ids, host.Status.PreviousTunnelId)
+	}
+	creds, err := r.GetArgonautTunnelCredentials(ctx, host)
+	if err != nil {
+		// The referenced Secret may be gone already, status is all we have then.
+		log.FromContext(ctx).Error(err, "unable to read tunnel credentials during teardown")
+		creds = &tunnelCredentials{}
+	}
+	if len(creds.TunnelID) != 0 && creds.TunnelID != host.Status.TunnelId && creds.TunnelID != host.Status.PreviousTunnelId {
+		ids = append(ids, creds.TunnelID)
+	}
+
+	var tuns []cloudflare.ArgoTunnel
+	for _, id := range ids {
+		tun, err := r.GetArgoTunnelByID(ctx, cfc, id)
+		if err != nil {
+			return err
+		}
+		if len(tun.ID) != 0 {
+			tuns = append(tuns, tun)
+		}
+	}
+	if len(tuns) == 0 && len(host.Status.TunnelId) == 0 {
+		// Never got as far as recording the tunnel, look it up by name instead.
+		tun, err := r.GetArgoTunnel(ctx, cfc, host.TunnelName)
+		if err != nil {
+			return err
+		}
+		if len(tun.ID) != 0 {
+			tuns = append(tuns, tun)
+		}
+	}
+	if len(tuns) == 0 {
+		log.FromContext(ctx).Info("Argo Tunnel already gone", "tunnel", host.TunnelName)
+		return nil
+	}
+
+	for i := range tuns {
+		for j := range host.Argonauts {
+			if err := r.DeleteDNSRecords(ctx, cfc, &host.Argonauts[j], &tuns[i]); err != nil {
+				return err
+			}
+		}
+		if creds.Adopted && tuns[i].ID == creds.TunnelID {
+			log.FromContext(ctx).Info("leaving adopted Argo Tunnel in place", "id", tuns[i].ID, "name", tuns[i].Name)
+			continue
+		}
+		if err := cfc.CleanupArgoTunnelConnections(ctx, cfc.AccountID, tuns[i].ID); err != nil {
+			return err
+		}
+		if err := r.DeleteArgoTunnel(ctx, cfc, &tuns[i]); err != nil {
+			return err
+		}
+		r.Recorder.Eventf(host.Owner, v1.EventTypeNormal, eventTunnelDeleted, "Deleted Argo Tunnel %s (%s)", tuns[i].Name, tuns[i].ID)
+	}
+	return nil
+}
+
+// Deletes the cloudflared Deployment in the foreground. Returns true once it no longer exists.
+func (r *ArgonautReconciler) DeleteArgonautDeployment(ctx context.Context, host *tunnelHost) (bool, error) {
+	var deployment appsv1.Deployment
+	if err := r.Get(ctx, client.ObjectKey{Name: host.Name, Namespace: host.Namespace}, &deployment); err != nil {
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	if deployment.DeletionTimestamp.IsZero() {
+		if err := r.Delete(ctx, &deployment, client.PropagationPolicy(metav1.DeletePropagationForeground)); err != nil {
+			return false, client.IgnoreNotFound(err)
+		}
+		log.FromContext(ctx).Info("Deleted Argonaut Deployment", "name", deployment.Name)
+	}
+	return false, nil
+}
+
+// Drops the owner reference to the tunnel from the named object, so the garbage collector leaves
+// it behind.
+func (r *ArgonautReconciler) releaseObject(ctx context.Context, host *tunnelHost, obj client.Object, name string) error {
+	if err := r.Get(ctx, client.ObjectKey{Name: name, Namespace: host.Namespace}, obj); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	var refs []metav1.OwnerReference
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.UID != host.Owner.GetUID() {
+			refs = append(refs, ref)
+		}
+	}
+	if len(refs) == len(obj.GetOwnerReferences()) {
+		return nil
+	}
+	obj.SetOwnerReferences(refs)
+	if err := r.Update(ctx, obj); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	log.FromContext(ctx).Info("Released object", "name", name, "namespace", host.Namespace)
+	return nil
+}
+
+// Deletes the named object if it is still around.
+func (r *ArgonautReconciler) deleteIfExists(ctx context.Context, obj client.Object, name string, namespace string) error {
+	if err := r.Get(ctx, client.ObjectKey{Name: name, Namespace: namespace}, obj); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if err := r.Delete(ctx, obj); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	log.FromContext(ctx).Info("Deleted object", "name", name, "namespace", namespace)
+	return nil
+}
@@ -0,0 +1,161 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	argonautv1 "github.com/laetho/argonaut/api/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Namespaces an ingress rule selects Services and Endpoints from. Just the namespace of the
+// Argonaut, unless the rule has a namespaceSelector.
+func (r *ArgonautReconciler) RuleNamespaces(ctx context.Context, argonaut *argonautv1.Argonaut, ingress argonautv1.ArgonautIngressRule) ([]string, error) {
+	if ingress.NamespaceSelector == nil {
+		return []string{argonaut.Namespace}, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(ingress.NamespaceSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	var namespaces v1.NamespaceList
+	if err := r.List(ctx, &namespaces, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, namespace := range namespaces.Items {
+		names = append(names, namespace.Name)
+	}
+	return names, nil
+}
+
+// Checks whether the Argonaut may route to an object with the given labels in another namespace,
+// which takes a ServiceGrant there naming the namespace of the Argonaut. Its own namespace is
+// always allowed.
+func (r *ArgonautReconciler) Granted(ctx context.Context, argonaut *argonautv1.Argonaut, namespace string, set map[string]string) (bool, error) {
+	if namespace == argonaut.Namespace {
+		return true, nil
+	}
+
+	var grants argonautv1.ServiceGrantList
+	if err := r.List(ctx, &grants, client.InNamespace(namespace)); err != nil {
+		return false, err
+	}
+	for _, grant := range grants.Items {
+		if !grantsNamespace(&grant, argonaut.Namespace) {
+			continue
+		}
+		if grant.Spec.ServiceSelector == nil {
+			return true, nil
+		}
+		selector, err := metav1.LabelSelectorAsSelector(grant.Spec.ServiceSelector)
+		if err != nil {
+			// A broken selector grants nothing.
+			continue
+		}
+		if selector.Matches(labels.Set(set)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Lists the Services selected by an ingress rule. Services in other namespaces without a
+// ServiceGrant are returned separately as denied.
+func (r *ArgonautReconciler) SelectServices(ctx context.Context, argonaut *argonautv1.Argonaut, ingress argonautv1.ArgonautIngressRule) ([]v1.Service, []v1.Service, error) {
+	selector, err := ruleSelector(ingress.ServiceSelector)
+	if err != nil {
+		return nil, nil, err
+	}
+	namespaces, err := r.RuleNamespaces(ctx, argonaut, ingress)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var allowed, denied []v1.Service
+	for _, namespace := range namespaces {
+		var svc v1.ServiceList
+		if err := r.List(ctx, &svc, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+			return nil, nil, err
+		}
+		for _, service := range svc.Items {
+			if service.Labels["app.kubernetes.io/managed-by"] == "argonaut" {
+				// Our own metrics Services are never a backend.
+				continue
+			}
+			ok, err := r.Granted(ctx, argonaut, service.Namespace, service.Labels)
+			if err != nil {
+				return nil, nil, err
+			}
+			if ok {
+				allowed = append(allowed, service)
+			} else {
+				denied = append(denied, service)
+			}
+		}
+	}
+	return allowed, denied, nil
+}
+
+// Lists the Endpoints selected by an ingress rule, the same way as SelectServices.
+func (r *ArgonautReconciler) SelectEndpoints(ctx context.Context, argonaut *argonautv1.Argonaut, ingress argonautv1.ArgonautIngressRule) ([]v1.Endpoints, []v1.Endpoints, error) {
+	selector, err := ruleSelector(ingress.EndpointsSelector)
+	if err != nil {
+		return nil, nil, err
+	}
+	namespaces, err := r.RuleNamespaces(ctx, argonaut, ingress)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var allowed, denied []v1.Endpoints
+	for _, namespace := range namespaces {
+		var eps v1.EndpointsList
+		if err := r.List(ctx, &eps, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+			return nil, nil, err
+		}
+		for _, endpoints := range eps.Items {
+			if endpoints.Labels["app.kubernetes.io/managed-by"] == "argonaut" {
+				continue
+			}
+			ok, err := r.Granted(ctx, argonaut, endpoints.Namespace, endpoints.Labels)
+			if err != nil {
+				return nil, nil, err
+			}
+			if ok {
+				allowed = append(allowed, endpoints)
+			} else {
+				denied = append(denied, endpoints)
+			}
+		}
+	}
+	return allowed, denied, nil
+}
+
+// Checks if a label selector of a rule selects anything at all. An empty one would match every
+// object in the namespace.
+func selectorSet(selector metav1.LabelSelector) bool {
+	return len(selector.MatchLabels) != 0 || len(selector.MatchExpressions) != 0
+}
+
+// Turns the serviceSelector or endpointsSelector of a rule into a selector for List, refusing empty
+// ones.
+func ruleSelector(selector metav1.LabelSelector) (labels.Selector, error) {
+	if !selectorSet(selector) {
+		return nil, fmt.Errorf("selector is empty")
+	}
+	return metav1.LabelSelectorAsSelector(&selector)
+}
+
+// Checks if a ServiceGrant lets in the given namespace.
+func grantsNamespace(grant *argonautv1.ServiceGrant, namespace string) bool {
+	for _, from := range grant.Spec.From {
+		if from.Namespace == namespace {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/cloudflare/cloudflare-go"
+	argonautv1 "github.com/laetho/argonaut/api/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// An Argo Tunnel along with the cloudflared Deployment running it. Either run by a single
+// Argonaut for itself, or by an ArgoTunnel on behalf of every Argonaut referencing it.
+type tunnelHost struct {
+	// Object the tunnel belongs to, owner of the Deployment.
+	Owner client.Object
+
+	// Name and namespace of the Deployment and ConfigMap.
+	Name      string
+	Namespace string
+
+	// Name of the tunnel in Cloudflare.
+	TunnelName string
+
+	// Optional credentials for an existing tunnel, see ArgonautSpec.ArgoTunnelSecret.
+	TunnelSecret v1.SecretReference
+
+	CFAuthSecret   v1.SecretReference
+	DeletionPolicy argonautv1.DeletionPolicy
+
+	// Catch-all rule of the cloudflared config, 404 if nil.
+	DefaultBackend *argonautv1.ArgonautDefaultBackend
+
+	// Settings for the cloudflared Deployment, defaults if nil.
+	Deployment *argonautv1.CloudflaredDeployment
+
+	// Why CA bundles referenced through caPool can't be mounted, by path. Rules using them are
+	// left out of the config.
+	MissingCABundles map[string]string
+
+	// Argonauts contributing ingress rules to the tunnel.
+	Argonauts []argonautv1.Argonaut
+
+	// Status and conditions of the owner, updated in place.
+	Status     *argonautv1.TunnelStatus
+	Conditions *[]metav1.Condition
+}
+
+// The tunnel an Argonaut runs on its own.
+func argonautTunnelHost(argonaut *argonautv1.Argonaut) *tunnelHost {
+	return &tunnelHost{
+		Owner:          argonaut,
+		Name:           argonaut.Name,
+		Namespace:      argonaut.Namespace,
+		TunnelName:     argonaut.Spec.ArgoTunnelName,
+		TunnelSecret:   argonaut.Spec.ArgoTunnelSecret,
+		CFAuthSecret:   argonaut.Spec.CFAuthSecret,
+		DeletionPolicy: argonaut.Spec.DeletionPolicy,
+		DefaultBackend: argonaut.Spec.DefaultBackend,
+		Deployment:     argonaut.Spec.Deployment,
+		Argonauts:      []argonautv1.Argonaut{*argonaut},
+		Status:         &argonaut.Status.TunnelStatus,
+		Conditions:     &argonaut.Status.Conditions,
+	}
+}
+
+// The tunnel of an ArgoTunnel, shared by the given Argonauts.
+func argoTunnelHost(tunnel *argonautv1.ArgoTunnel, argonauts []argonautv1.Argonaut) *tunnelHost {
+	name := tunnel.Spec.TunnelName
+	if len(name) == 0 {
+		name = tunnel.Name
+	}
+	return &tunnelHost{
+		Owner:          tunnel,
+		Name:           tunnel.Name,
+		Namespace:      tunnel.Spec.Namespace,
+		TunnelName:     name,
+		TunnelSecret:   tunnel.Spec.ArgoTunnelSecret,
+		CFAuthSecret:   tunnel.Spec.CFAuthSecret,
+		DeletionPolicy: tunnel.Spec.DeletionPolicy,
+		DefaultBackend: tunnel.Spec.DefaultBackend,
+		Deployment:     tunnel.Spec.Deployment,
+		Argonauts:      argonauts,
+		Status:         &tunnel.Status.TunnelStatus,
+		Conditions:     &tunnel.Status.Conditions,
+	}
+}
+
+// Whether the tunnel is that of an ArgoTunnel, shared by Argonauts of other namespaces.
+func (h *tunnelHost) Shared() bool {
+	_, ok := h.Owner.(*argonautv1.ArgoTunnel)
+	return ok
+}
+
+// Makes the object the tunnel belongs to the controller of a generated object, so it goes away
+// along with it and changes to the object are traced back to it.
+func (r *ArgonautReconciler) setHostOwner(host *tunnelHost, obj client.Object) error {
+	// Earlier versions set a reference without controller flag, drop it rather than add a second.
+	var refs []metav1.OwnerReference
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.UID != host.Owner.GetUID() || (ref.Controller != nil && *ref.Controller) {
+			refs = append(refs, ref)
+		}
+	}
+	obj.SetOwnerReferences(refs)
+	return controllerutil.SetControllerReference(host.Owner, obj, r.Scheme)
+}
+
+// Runs the tunnel of a host: the Argo Tunnel with its credentials, the cloudflared config and the
+// Deployment, and moves status over to a replacement tunnel once it is connected. Sets the
+// TunnelReady, ConfigReady and DeploymentAvailable conditions. Returns true while waiting for
+// the replacement tunnel to connect.
+func (r *ArgonautReconciler) ReconcileTunnelHost(ctx context.Context, cfc *cloudflare.API, host *tunnelHost) (*cloudflare.ArgoTunnel, *tunnelCredentials, bool, error) {
+	generation := host.Owner.GetGeneration()
+
+	missing, err := r.MissingCABundles(ctx, host.Namespace, referencedCABundles(host))
+	if err != nil {
+		log.FromContext(ctx).Error(err, "unable to check CA bundles", "name", host.Name)
+		setCondition(host.Conditions, generation, argonautv1.ConditionConfigReady, metav1.ConditionFalse, reasonConfigFailed, err.Error())
+		return nil, nil, false, err
+	}
+	host.MissingCABundles = missing
+
+	tun, creds, err := r.ReconcileArgoTunnel(ctx, cfc, host)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "unable to reconcile tunnel", "name", host.Name)
+		setCondition(host.Conditions, generation, argonautv1.ConditionTunnelReady, metav1.ConditionFalse, reasonTunnelFailed, err.Error())
+		return nil, nil, false, err
+	}
+
+	// Create ConfigMap, will be mapped into Pod
+	config, err := r.ReconcileArgonautTunnelConfig(ctx, host, tun)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "unable to reconcile ConfigMap", "name", host.Name)
+		setCondition(host.Conditions, generation, argonautv1.ConditionConfigReady, metav1.ConditionFalse, reasonConfigFailed, err.Error())
+		return nil, nil, false, err
+	}
+	setCondition(host.Conditions, generation, argonautv1.ConditionConfigReady, metav1.ConditionTrue, reasonReconciled, "")
+
+	deployment, err := r.ReconcileArgonautDeployment(ctx, host, tun, creds, config)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "unable to reconcile Deployment", "name", host.Name)
+		setCondition(host.Conditions, generation, argonautv1.ConditionDeploymentAvailable, metav1.ConditionFalse, reasonDeploymentFailed, err.Error())
+		return nil, nil, false, err
+	}
+	if err := r.ReconcileMetricsService(ctx, host); err != nil {
+		log.FromContext(ctx).Error(err, "unable to reconcile metrics Service", "name", host.Name)
+		setCondition(host.Conditions, generation, argonautv1.ConditionDeploymentAvailable, metav1.ConditionFalse, reasonDeploymentFailed, err.Error())
+		return nil, nil, false, err
+	}
+	if err := r.ReconcilePodDisruptionBudget(ctx, host, deploymentSettings(host)); err != nil {
+		log.FromContext(ctx).Error(err, "unable to reconcile PodDisruptionBudget", "name", host.Name)
+		setCondition(host.Conditions, generation, argonautv1.ConditionDeploymentAvailable, metav1.ConditionFalse, reasonDeploymentFailed, err.Error())
+		return nil, nil, false, err
+	}
+	if err := r.ReconcileAutoscaler(ctx, host, deploymentSettings(host)); err != nil {
+		log.FromContext(ctx).Error(err, "unable to reconcile HorizontalPodAutoscaler", "name", host.Name)
+		setCondition(host.Conditions, generation, argonautv1.ConditionDeploymentAvailable, metav1.ConditionFalse, reasonDeploymentFailed, err.Error())
+		return nil, nil, false, err
+	}
+	available, message := deploymentAvailability(deployment)
+	if available {
+		setCondition(host.Conditions, generation, argonautv1.ConditionDeploymentAvailable, metav1.ConditionTrue, reasonReconciled, message)
+	} else {
+		setCondition(host.Conditions, generation, argonautv1.ConditionDeploymentAvailable, metav1.ConditionFalse, reasonDeploymentUnavailable, message)
+	}
+
+	switching, err := r.SwitchArgoTunnel(ctx, cfc, host, tun, creds)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "unable to switch tunnel", "tunnel", tun.ID)
+		setCondition(host.Conditions, generation, argonautv1.ConditionTunnelReady, metav1.ConditionFalse, reasonTunnelFailed, err.Error())
+		return nil, nil, false, err
+	}
+	if switching {
+		// The tunnel in status keeps serving until the replacement has connected.
+		setCondition(host.Conditions, generation, argonautv1.ConditionTunnelReady, metav1.ConditionTrue, reasonTunnelSwitching,
+			fmt.Sprintf("waiting for tunnel %s to connect", tun.ID))
+	} else {
+		setCondition(host.Conditions, generation, argonautv1.ConditionTunnelReady, metav1.ConditionTrue, reasonReconciled, "")
+	}
+
+	return tun, creds, switching, nil
+}
@@ -0,0 +1,112 @@
+package controllers
+
+import (
+	"context"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// Port cloudflared serves /metrics and /ready on.
+	metricsPort     = 2000
+	metricsPortName = "metrics"
+)
+
+// Labels of the Service exposing cloudflared metrics, selected by the ServiceMonitor in
+// config/prometheus.
+func metricsServiceLabels(host *tunnelHost) map[string]string {
+	return map[string]string{
+		"argonaut":                     host.Name,
+		"app.kubernetes.io/name":       "cloudflared",
+		"app.kubernetes.io/managed-by": "argonaut",
+	}
+}
+
+// Name of the Service exposing cloudflared metrics.
+func metricsServiceName(host *tunnelHost) string {
+	return host.Name + "-metrics"
+}
+
+// Creates or updates the Service exposing the metrics of the cloudflared pods of a tunnel.
+func (r *ArgonautReconciler) ReconcileMetricsService(ctx context.Context, host *tunnelHost) error {
+	desired := v1.ServiceSpec{
+		Selector: map[string]string{"argonaut": host.Name},
+		Ports: []v1.ServicePort{{
+			Name:       metricsPortName,
+			Port:       metricsPort,
+			TargetPort: intstr.FromString(metricsPortName),
+			Protocol:   v1.ProtocolTCP,
+		}},
+	}
+
+	var service v1.Service
+	if err := r.Get(ctx, client.ObjectKey{Name: metricsServiceName(host), Namespace: host.Namespace}, &service); err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		service.Name = metricsServiceName(host)
+		service.Namespace = host.Namespace
+		service.Labels = metricsServiceLabels(host)
+		service.Spec = desired
+		if err := r.setHostOwner(host, &service); err != nil {
+			return err
+		}
+		if err := r.Create(ctx, &service); err != nil {
+			return err
+		}
+		log.FromContext(ctx).Info("Created metrics Service", "name", service.Name)
+		return nil
+	}
+
+	if equality.Semantic.DeepDerivative(metricsServiceLabels(host), service.Labels) &&
+		equality.Semantic.DeepDerivative(desired, service.Spec) && metav1.IsControlledBy(&service, host.Owner) {
+		return nil
+	}
+	service.Labels = metricsServiceLabels(host)
+	if err := r.setHostOwner(host, &service); err != nil {
+		return err
+	}
+	service.Spec.Selector = desired.Selector
+	service.Spec.Ports = desired.Ports
+	if err := r.Update(ctx, &service); err != nil {
+		return err
+	}
+	log.FromContext(ctx).Info("Updated metrics Service", "name", service.Name)
+	return nil
+}
+
+// Probe on the cloudflared /ready endpoint, which answers 200 while the tunnel has at least one
+// connection to the Cloudflare edge.
+func readyProbe() *v1.Probe {
+	return &v1.Probe{
+		ProbeHandler: v1.ProbeHandler{
+			HTTPGet: &v1.HTTPGetAction{
+				Path: "/ready",
+				Port: intstr.FromString(metricsPortName),
+			},
+		},
+		InitialDelaySeconds: 10,
+		PeriodSeconds:       10,
+		FailureThreshold:    3,
+	}
+}
+
+// Probe on the metrics port, open for as long as cloudflared runs. Losing the edge is no reason to
+// restart, a new pod would have no better luck reaching it.
+func liveProbe() *v1.Probe {
+	return &v1.Probe{
+		ProbeHandler: v1.ProbeHandler{
+			TCPSocket: &v1.TCPSocketAction{
+				Port: intstr.FromString(metricsPortName),
+			},
+		},
+		InitialDelaySeconds: 10,
+		PeriodSeconds:       10,
+		FailureThreshold:    6,
+	}
+}
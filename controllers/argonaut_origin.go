@@ -0,0 +1,297 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	argonautv1 "github.com/laetho/argonaut/api/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strconv"
+)
+
+const (
+	// Where CA bundles referenced by caPool are mounted in the cloudflared container.
+	caBundleMountPath = "/etc/cloudflare/ca"
+)
+
+// A CA bundle to mount into cloudflared, from a ConfigMap or a Secret.
+type caBundle struct {
+	ConfigMap string
+	Secret    string
+	Key       string
+}
+
+func newCABundle(ref *argonautv1.CABundle) *caBundle {
+	switch {
+	case ref == nil:
+		return nil
+	case ref.ConfigMapKeyRef != nil:
+		return &caBundle{ConfigMap: ref.ConfigMapKeyRef.Name, Key: ref.ConfigMapKeyRef.Key}
+	case ref.SecretKeyRef != nil:
+		return &caBundle{Secret: ref.SecretKeyRef.Name, Key: ref.SecretKeyRef.Key}
+	}
+	return nil
+}
+
+// Directory the ConfigMap or Secret of the bundle is mounted in.
+func (b *caBundle) dir() string {
+	if len(b.ConfigMap) != 0 {
+		return caBundleMountPath + "/configmap-" + b.ConfigMap
+	}
+	return caBundleMountPath + "/secret-" + b.Secret
+}
+
+// Path of the bundle in the cloudflared container.
+func (b *caBundle) Path() string {
+	return b.dir() + "/" + b.Key
+}
+
+// Merges the originRequest of an ingress rule over the defaults of its Argonaut into the
+// cloudflared config form. Returns nil if neither sets anything.
+func originRequestConfig(defaults *argonautv1.OriginRequest, rule *argonautv1.OriginRequest) *ArgonautTunnelConfigOriginRequest {
+	if defaults == nil && rule == nil {
+		return nil
+	}
+	conf := &ArgonautTunnelConfigOriginRequest{}
+	for _, o := range []*argonautv1.OriginRequest{defaults, rule} {
+		if o == nil {
+			continue
+		}
+		if o.ConnectTimeout != nil {
+			conf.ConnectTimeout = o.ConnectTimeout.Duration.String()
+		}
+		if o.NoTLSVerify != nil {
+			conf.NoTLSVerify = o.NoTLSVerify
+		}
+		if len(o.OriginServerName) != 0 {
+			conf.OriginServerName = o.OriginServerName
+		}
+		if bundle := newCABundle(o.CAPool); bundle != nil {
+			conf.CAPool = bundle.Path()
+		}
+		if len(o.HTTPHostHeader) != 0 {
+			conf.HTTPHostHeader = o.HTTPHostHeader
+		}
+		if o.KeepAliveConnections != nil {
+			conf.KeepAliveConnections = o.KeepAliveConnections
+		}
+		if o.DisableChunkedEncoding != nil {
+			conf.DisableChunkedEncoding = o.DisableChunkedEncoding
+		}
+		if len(o.ProxyType) != 0 {
+			conf.ProxyType = o.ProxyType
+		}
+		if o.Access != nil {
+			conf.Access = &ArgonautTunnelConfigAccess{
+				Required: o.Access.Required,
+				TeamName: o.Access.TeamName,
+				AudTag:   o.Access.AudTag,
+			}
+		}
+	}
+	return conf
+}
+
+// CA bundles referenced by a tunnel and its Argonauts, once each and in a stable order. Argonauts
+// sharing an ArgoTunnel don't get to mount anything, see markSharedCAPools.
+func referencedCABundles(host *tunnelHost) []caBundle {
+	var origins []*argonautv1.OriginRequest
+	if host.DefaultBackend != nil {
+		origins = append(origins, host.DefaultBackend.OriginRequest)
+	}
+	if !host.Shared() {
+		for i := range host.Argonauts {
+			origins = append(origins, argonautOriginRequests(&host.Argonauts[i])...)
+		}
+	}
+	return uniqueCABundles(origins)
+}
+
+// The CA bundles of a set of originRequest sections, once each and sorted by path.
+func uniqueCABundles(origins []*argonautv1.OriginRequest) []caBundle {
+	seen := make(map[string]bool)
+	var bundles []caBundle
+	for _, o := range origins {
+		if o == nil {
+			continue
+		}
+		if bundle := newCABundle(o.CAPool); bundle != nil && !seen[bundle.Path()] {
+			seen[bundle.Path()] = true
+			bundles = append(bundles, *bundle)
+		}
+	}
+	sort.Slice(bundles, func(i, j int) bool {
+		return bundles[i].Path() < bundles[j].Path()
+	})
+	return bundles
+}
+
+// The originRequest sections of an Argonaut, its own followed by those of its rules.
+func argonautOriginRequests(argonaut *argonautv1.Argonaut) []*argonautv1.OriginRequest {
+	origins := []*argonautv1.OriginRequest{argonaut.Spec.OriginRequest}
+	for _, ingress := range argonaut.Spec.Ingress {
+		origins = append(origins, ingress.OriginRequest)
+	}
+	return origins
+}
+
+// CA bundles to mount into cloudflared, leaving out those that can't be mounted.
+func caBundles(host *tunnelHost) []caBundle {
+	var bundles []caBundle
+	for _, bundle := range referencedCABundles(host) {
+		if _, missing := host.MissingCABundles[bundle.Path()]; !missing {
+			bundles = append(bundles, bundle)
+		}
+	}
+	return bundles
+}
+
+// Checks that the ConfigMaps and Secrets behind CA bundles exist in the namespace cloudflared
+// runs in and have the key, holding PEM certificates. A pod mounting a missing one never starts,
+// and on a shared tunnel that would hold up every Argonaut. Returns why for each bundle path that
+// can't be used.
+func (r *ArgonautReconciler) MissingCABundles(ctx context.Context, namespace string, bundles []caBundle) (map[string]string, error) {
+	missing := make(map[string]string)
+	for _, bundle := range bundles {
+		var data []byte
+		var found bool
+		var kind, name string
+		if len(bundle.ConfigMap) != 0 {
+			kind, name = "ConfigMap", bundle.ConfigMap
+			var cm v1.ConfigMap
+			if err := r.Get(ctx, client.ObjectKey{Name: name, Namespace: namespace}, &cm); err != nil {
+				if !errors.IsNotFound(err) {
+					return nil, err
+				}
+				missing[bundle.Path()] = fmt.Sprintf("caPool ConfigMap %s/%s not found", namespace, name)
+				continue
+			}
+			var value string
+			value, found = cm.Data[bundle.Key]
+			data = []byte(value)
+			if !found {
+				data, found = cm.BinaryData[bundle.Key]
+			}
+		} else {
+			kind, name = "Secret", bundle.Secret
+			var secret v1.Secret
+			if err := r.Get(ctx, client.ObjectKey{Name: name, Namespace: namespace}, &secret); err != nil {
+				if !errors.IsNotFound(err) {
+					return nil, err
+				}
+				missing[bundle.Path()] = fmt.Sprintf("caPool Secret %s/%s not found", namespace, name)
+				continue
+			}
+			data, found = secret.Data[bundle.Key]
+		}
+		switch {
+		case !found:
+			missing[bundle.Path()] = fmt.Sprintf("caPool %s %s/%s has no key %s", kind, namespace, name, bundle.Key)
+		case !pemCertificates(data):
+			missing[bundle.Path()] = fmt.Sprintf("caPool %s %s/%s key %s holds no PEM certificate", kind, namespace, name, bundle.Key)
+		}
+	}
+	return missing, nil
+}
+
+// Whether data holds PEM encoded certificates and nothing else, as cloudflared expects of a CA
+// pool. Keeps keys meant for something else, like tunnel credentials, out of the config.
+func pemCertificates(data []byte) bool {
+	found := false
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			return found && len(bytes.TrimSpace(rest)) == 0
+		}
+		if block.Type != "CERTIFICATE" {
+			return false
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return false
+		}
+		found = true
+		data = rest
+	}
+}
+
+// Path of the CA bundle in an originRequest config, empty if it has none.
+func caPoolPath(conf *ArgonautTunnelConfigOriginRequest) string {
+	if conf == nil {
+		return ""
+	}
+	return conf.CAPool
+}
+
+// Drops the backends of rules whose CA bundle can't be mounted from the rule statuses, warning
+// about them instead. cloudflared won't load a config pointing at a CA file that isn't there, so
+// these rules are left out.
+func markMissingCABundles(argonaut *argonautv1.Argonaut, missing map[string]string) {
+	for i := range argonaut.Status.Rules {
+		if i >= len(argonaut.Spec.Ingress) {
+			break
+		}
+		conf := originRequestConfig(argonaut.Spec.OriginRequest, argonaut.Spec.Ingress[i].OriginRequest)
+		if why, ok := missing[caPoolPath(conf)]; ok {
+			argonaut.Status.Rules[i].Services = nil
+			argonaut.Status.Rules[i].Warning = why
+		}
+	}
+}
+
+// Drops the backends of rules with a CA bundle from the rule statuses of an Argonaut on a shared
+// ArgoTunnel, warning about them instead. cloudflared runs in the namespace of the ArgoTunnel,
+// where nothing grants the Argonaut its ConfigMaps and Secrets, so these rules are left out.
+// Returns whether there were any.
+func markSharedCAPools(argonaut *argonautv1.Argonaut, tunnel string) bool {
+	rejected := false
+	for i := range argonaut.Status.Rules {
+		if i >= len(argonaut.Spec.Ingress) {
+			break
+		}
+		conf := originRequestConfig(argonaut.Spec.OriginRequest, argonaut.Spec.Ingress[i].OriginRequest)
+		if len(caPoolPath(conf)) != 0 {
+			argonaut.Status.Rules[i].Services = nil
+			argonaut.Status.Rules[i].Warning = "caPool is not allowed on an Argonaut sharing ArgoTunnel " + tunnel
+			rejected = true
+		}
+	}
+	return rejected
+}
+
+// Volumes and mounts for the CA bundles of a tunnel. Bundles from the same ConfigMap or Secret
+// share a volume.
+func caBundleVolumes(bundles []caBundle) ([]v1.Volume, []v1.VolumeMount) {
+	var volumes []v1.Volume
+	var mounts []v1.VolumeMount
+	index := make(map[string]int)
+	for _, bundle := range bundles {
+		i, ok := index[bundle.dir()]
+		if !ok {
+			i = len(volumes)
+			index[bundle.dir()] = i
+			volume := v1.Volume{Name: "ca-" + strconv.Itoa(i)}
+			if len(bundle.ConfigMap) != 0 {
+				volume.ConfigMap = &v1.ConfigMapVolumeSource{
+					LocalObjectReference: v1.LocalObjectReference{Name: bundle.ConfigMap},
+				}
+			} else {
+				volume.Secret = &v1.SecretVolumeSource{SecretName: bundle.Secret}
+			}
+			volumes = append(volumes, volume)
+			mounts = append(mounts, v1.VolumeMount{Name: volume.Name, ReadOnly: true, MountPath: bundle.dir()})
+		}
+		items := &volumes[i].VolumeSource
+		key := v1.KeyToPath{Key: bundle.Key, Path: bundle.Key}
+		if items.ConfigMap != nil {
+			items.ConfigMap.Items = append(items.ConfigMap.Items, key)
+		} else {
+			items.Secret.Items = append(items.Secret.Items, key)
+		}
+	}
+	return volumes, mounts
+}
@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cloudflare/cloudflare-go"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const (
+	// Page size when listing DNS records, the most the API hands out at once.
+	dnsRecordsPerPage = 100
+)
+
+// A DNS record along with the fields cloudflare-go does not know about yet. Requests go through
+// cfc.Raw so they carry these.
+type dnsRecord struct {
+	cloudflare.DNSRecord
+	Comment string   `json:"comment,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+}
+
+// Lists the DNS records of a zone, optionally only those of a type or name.
+func listDNSRecords(ctx context.Context, cfc *cloudflare.API, zoneid string, recordType string, name string) ([]dnsRecord, error) {
+	v := url.Values{}
+	v.Set("per_page", strconv.Itoa(dnsRecordsPerPage))
+	if len(recordType) != 0 {
+		v.Set("type", recordType)
+	}
+	if len(name) != 0 {
+		v.Set("name", name)
+	}
+
+	var records []dnsRecord
+	for page := 1; ; page++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		v.Set("page", strconv.Itoa(page))
+		res, err := cfc.Raw(http.MethodGet, fmt.Sprintf("/zones/%s/dns_records?%s", zoneid, v.Encode()), nil)
+		if err != nil {
+			return nil, err
+		}
+		var batch []dnsRecord
+		if err := json.Unmarshal(res, &batch); err != nil {
+			return nil, err
+		}
+		records = append(records, batch...)
+		if len(batch) < dnsRecordsPerPage {
+			return records, nil
+		}
+	}
+}
+
+// Creates a DNS record in a zone.
+func createDNSRecord(cfc *cloudflare.API, zoneid string, record dnsRecord) error {
+	_, err := cfc.Raw(http.MethodPost, fmt.Sprintf("/zones/%s/dns_records", zoneid), record)
+	return err
+}
+
+// Changes the fields set in the given record on an existing DNS record.
+func patchDNSRecord(cfc *cloudflare.API, zoneid string, id string, record dnsRecord) error {
+	_, err := cfc.Raw(http.MethodPatch, fmt.Sprintf("/zones/%s/dns_records/%s", zoneid, id), record)
+	return err
+}
@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/cloudflare/cloudflare-go"
+	argonautv1 "github.com/laetho/argonaut/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"strings"
+)
+
+// Every DNS record Argonaut creates is claimed by a TXT record next to it, external-dns style:
+//
+//	_argonaut.app.example.com TXT "heritage=argonaut,argonaut/owner=<cluster id>,argonaut/resource=argonaut/<namespace>/<name>"
+//
+// A CNAME can't share its name with other records, hence the prefix. The claim tells records we
+// created apart from those of other teams, clusters or Argonauts.
+const (
+	registryPrefix         = "_argonaut."
+	registryWildcardPrefix = "_argonaut-wildcard."
+	registryHeritage       = "argonaut"
+	defaultClusterID       = "default"
+)
+
+// Owner of a DNS record according to its registry TXT record.
+type recordOwner struct {
+	Cluster  string
+	Resource string
+}
+
+func (o recordOwner) String() string {
+	return fmt.Sprintf("%s in cluster %s", o.Resource, o.Cluster)
+}
+
+// The owner an Argonaut claims its records as.
+func (r *ArgonautReconciler) argonautOwner(argonaut *argonautv1.Argonaut) recordOwner {
+	cluster := r.ClusterID
+	if len(cluster) == 0 {
+		cluster = defaultClusterID
+	}
+	return recordOwner{
+		Cluster:  cluster,
+		Resource: fmt.Sprintf("argonaut/%s/%s", argonaut.Namespace, argonaut.Name),
+	}
+}
+
+// Name of the TXT record claiming the record of a hostname.
+func registryRecordName(hostname string) string {
+	if strings.HasPrefix(hostname, "*.") {
+		return registryWildcardPrefix + hostname[2:]
+	}
+	return registryPrefix + hostname
+}
+
+// Hostname whose record a registry TXT record claims.
+func registryHostname(name string) string {
+	name = strings.ToLower(name)
+	if strings.HasPrefix(name, registryWildcardPrefix) {
+		return "*." + strings.TrimPrefix(name, registryWildcardPrefix)
+	}
+	return strings.TrimPrefix(name, registryPrefix)
+}
+
+// Content of the TXT record claiming a record for an owner.
+func registryContent(owner recordOwner) string {
+	return fmt.Sprintf("heritage=%s,%s/owner=%s,%s/resource=%s", registryHeritage, registryHeritage, owner.Cluster, registryHeritage, owner.Resource)
+}
+
+// Reads the owner from the content of a registry TXT record. Returns false if the record was not
+// written by Argonaut.
+func parseRegistryContent(content string) (recordOwner, bool) {
+	labels := make(map[string]string)
+	for _, label := range strings.Split(strings.Trim(content, `"`), ",") {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) == 2 {
+			labels[parts[0]] = parts[1]
+		}
+	}
+	if labels["heritage"] != registryHeritage {
+		return recordOwner{}, false
+	}
+	return recordOwner{
+		Cluster:  labels[registryHeritage+"/owner"],
+		Resource: labels[registryHeritage+"/resource"],
+	}, true
+}
+
+// Fetch the registry TXT records of a zone.
+func (r *ArgonautReconciler) GetRegistryRecords(ctx context.Context, cfc *cloudflare.API, zoneid string) ([]dnsRecord, error) {
+	records, err := listDNSRecords(ctx, cfc, zoneid, "TXT", "")
+	if err != nil {
+		return nil, err
+	}
+	var registry []dnsRecord
+	for _, record := range records {
+		name := strings.ToLower(record.Name)
+		if strings.HasPrefix(name, registryPrefix) || strings.HasPrefix(name, registryWildcardPrefix) {
+			registry = append(registry, record)
+		}
+	}
+	return registry, nil
+}
+
+// Who claims the record of a hostname. Returns false if nobody does. A TXT record at the registry
+// name not written by Argonaut counts as a claim by an unknown owner.
+func recordClaim(registry []dnsRecord, hostname string) (recordOwner, dnsRecord, bool) {
+	exists, record := inDNSRecords(registry, registryRecordName(hostname))
+	if !exists {
+		return recordOwner{}, record, false
+	}
+	owner, ok := parseRegistryContent(record.Content)
+	if !ok {
+		owner = recordOwner{Cluster: "unknown", Resource: "TXT " + record.Content}
+	}
+	return owner, record, true
+}
+
+// Claims the record of a hostname for an owner.
+func (r *ArgonautReconciler) CreateRegistryRecord(ctx context.Context, cfc *cloudflare.API, hostname string, zoneid string, owner recordOwner) error {
+	record := cloudflare.DNSRecord{
+		Type:    "TXT",
+		Name:    registryRecordName(hostname),
+		Content: registryContent(owner),
+		TTL:     1,
+		ZoneID:  zoneid,
+	}
+	if _, err := cfc.CreateDNSRecord(ctx, zoneid, record); err != nil {
+		return err
+	}
+	log.FromContext(ctx).Info("Created registry record", "host", hostname, "owner", owner.String())
+	return nil
+}
@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"github.com/cloudflare/cloudflare-go"
+	argonautv1 "github.com/laetho/argonaut/api/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func TestRegistryRecordName(t *testing.T) {
+	tests := []struct {
+		hostname string
+		name     string
+	}{
+		{"app.example.com", "_argonaut.app.example.com"},
+		{"example.com", "_argonaut.example.com"},
+		{"*.example.com", "_argonaut-wildcard.example.com"},
+		{"*.dev.example.com", "_argonaut-wildcard.dev.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			name := registryRecordName(tt.hostname)
+			if name != tt.name {
+				t.Errorf("registryRecordName(%q) = %q, want %q", tt.hostname, name, tt.name)
+			}
+			if hostname := registryHostname(name); hostname != tt.hostname {
+				t.Errorf("registryHostname(%q) = %q, want %q", name, hostname, tt.hostname)
+			}
+		})
+	}
+
+	// Cloudflare may hand names back in another case.
+	if hostname := registryHostname("_Argonaut-Wildcard.Example.com"); hostname != "*.example.com" {
+		t.Errorf("registryHostname of mixed case wildcard claim = %q, want *.example.com", hostname)
+	}
+}
+
+func TestParseRegistryContent(t *testing.T) {
+	ours := recordOwner{Cluster: "prod", Resource: "argonaut/web/site"}
+	tests := []struct {
+		name    string
+		content string
+		owner   recordOwner
+		ok      bool
+	}{
+		{
+			name:    "written by us",
+			content: registryContent(ours),
+			owner:   ours,
+			ok:      true,
+		},
+		{
+			name:    "quoted",
+			content: `"` + registryContent(ours) + `"`,
+			owner:   ours,
+			ok:      true,
+		},
+		{
+			name:    "other cluster",
+			content: "heritage=argonaut,argonaut/owner=staging,argonaut/resource=argonaut/web/site",
+			owner:   recordOwner{Cluster: "staging", Resource: "argonaut/web/site"},
+			ok:      true,
+		},
+		{
+			name:    "labels in another order",
+			content: "argonaut/resource=argonaut/web/site,argonaut/owner=prod,heritage=argonaut",
+			owner:   ours,
+			ok:      true,
+		},
+		{
+			name:    "no heritage",
+			content: "argonaut/owner=prod,argonaut/resource=argonaut/web/site",
+		},
+		{
+			name:    "external-dns",
+			content: `"heritage=external-dns,external-dns/owner=default,external-dns/resource=ingress/web/site"`,
+		},
+		{
+			name:    "site verification",
+			content: "google-site-verification=abc123",
+		},
+		{
+			name: "empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			owner, ok := parseRegistryContent(tt.content)
+			if ok != tt.ok || owner != tt.owner {
+				t.Errorf("parseRegistryContent(%q) = %+v, %v, want %+v, %v", tt.content, owner, ok, tt.owner, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRecordClaim(t *testing.T) {
+	r := &ArgonautReconciler{ClusterID: "prod"}
+	ours := r.argonautOwner(&argonautv1.Argonaut{ObjectMeta: metav1.ObjectMeta{Name: "site", Namespace: "web"}})
+	theirs := recordOwner{Cluster: "staging", Resource: "argonaut/web/site"}
+	txt := func(name string, content string) dnsRecord {
+		return dnsRecord{DNSRecord: cloudflare.DNSRecord{Type: "TXT", Name: name, Content: content}}
+	}
+	registry := []dnsRecord{
+		txt("_argonaut.app.example.com", registryContent(ours)),
+		txt("_argonaut-wildcard.example.com", `"`+registryContent(ours)+`"`),
+		txt("_argonaut.api.example.com", registryContent(theirs)),
+		txt("_argonaut.www.example.com", "v=spf1 -all"),
+	}
+
+	tests := []struct {
+		hostname string
+		owner    recordOwner
+		claimed  bool
+	}{
+		{"app.example.com", ours, true},
+		{"APP.example.com", ours, true},
+		{"*.example.com", ours, true},
+		{"api.example.com", theirs, true},
+		{"www.example.com", recordOwner{Cluster: "unknown", Resource: "TXT v=spf1 -all"}, true},
+		{"example.com", recordOwner{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			owner, _, claimed := recordClaim(registry, tt.hostname)
+			if claimed != tt.claimed || owner != tt.owner {
+				t.Errorf("recordClaim(%q) = %+v, %v, want %+v, %v", tt.hostname, owner, claimed, tt.owner, tt.claimed)
+			}
+		})
+	}
+
+	if ours != (recordOwner{Cluster: "prod", Resource: "argonaut/web/site"}) {
+		t.Errorf("argonautOwner = %+v", ours)
+	}
+	if owner := (&ArgonautReconciler{}).argonautOwner(&argonautv1.Argonaut{ObjectMeta: metav1.ObjectMeta{Name: "site", Namespace: "web"}}); owner.Cluster != defaultClusterID {
+		t.Errorf("argonautOwner without cluster ID claims for cluster %q, want %q", owner.Cluster, defaultClusterID)
+	}
+}
@@ -0,0 +1,109 @@
+package controllers
+
+import (
+	"context"
+	"github.com/cloudflare/cloudflare-go"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// Setting this annotation to a new value rotates the tunnel secret. The value itself is
+	// only compared against status.tunnelSecretRotation, a timestamp works fine.
+	rotateTunnelSecretAnnotation = "argonaut.metalabs.no/rotate-tunnel-secret"
+
+	// Pod template annotation carrying the tunnel ID, rolls cloudflared when the tunnel changes.
+	tunnelIDAnnotation = "argonaut.metalabs.no/tunnel-id"
+)
+
+// Moves status over to the tunnel cloudflared now runs, after a secret rotation or when the old
+// tunnel disappeared. DNS stays on the tunnel in status until the new one has live connections,
+// the old tunnel is then kept as previousTunnelId until RetirePreviousArgoTunnel is done with it.
+// Returns true while waiting for the new tunnel to connect.
+func (r *ArgonautReconciler) SwitchArgoTunnel(ctx context.Context, cfc *cloudflare.API, host *tunnelHost, tun *cloudflare.ArgoTunnel, creds *tunnelCredentials) (bool, error) {
+	if host.Status.TunnelId == tun.ID {
+		return false, nil
+	}
+	if len(tun.Connections) == 0 {
+		log.FromContext(ctx).Info("waiting for replacement tunnel to connect", "tunnel", tun.ID)
+		return true, nil
+	}
+
+	if len(host.Status.PreviousTunnelId) != 0 {
+		// Rotated again before the last rotation finished. Nothing points at the tunnel in
+		// status any longer once DNS moves on, so it goes right away.
+		if err := r.deleteReplacedArgoTunnel(ctx, cfc, host, host.Status.TunnelId, creds); err != nil {
+			return true, err
+		}
+	} else {
+		host.Status.PreviousTunnelId = host.Status.TunnelId
+	}
+
+	log.FromContext(ctx).Info("switching DNS to replacement Argo Tunnel", "old", host.Status.TunnelId, "new", tun.ID)
+	r.Recorder.Eventf(host.Owner, v1.EventTypeNormal, eventTunnelSwitched, "Switching DNS from Argo Tunnel %s to %s", host.Status.TunnelId, tun.ID)
+	host.Status.TunnelId = tun.ID
+	return false, nil
+}
+
+// Deletes the tunnel in previousTunnelId once every cloudflared replica runs the tunnel in
+// status. Callers make sure DNS has moved over first. Adopted tunnels are left alone. Returns
+// true while waiting.
+func (r *ArgonautReconciler) RetirePreviousArgoTunnel(ctx context.Context, cfc *cloudflare.API, host *tunnelHost, creds *tunnelCredentials) (bool, error) {
+	if len(host.Status.PreviousTunnelId) == 0 {
+		return false, nil
+	}
+
+	var deployment appsv1.Deployment
+	if err := r.Get(ctx, client.ObjectKey{Name: host.Name, Namespace: host.Namespace}, &deployment); err != nil {
+		return true, client.IgnoreNotFound(err)
+	}
+	if !deploymentRolledOut(&deployment, host.Status.TunnelId) {
+		log.FromContext(ctx).Info("waiting for cloudflared to roll out replacement tunnel", "tunnel", host.Status.TunnelId)
+		return true, nil
+	}
+
+	if err := r.deleteReplacedArgoTunnel(ctx, cfc, host, host.Status.PreviousTunnelId, creds); err != nil {
+		return true, err
+	}
+	log.FromContext(ctx).Info("switched to replacement Argo Tunnel", "old", host.Status.PreviousTunnelId, "new", host.Status.TunnelId)
+	host.Status.PreviousTunnelId = ""
+	return false, nil
+}
+
+// Deletes a tunnel cloudflared moved away from, unless the user brought the tunnels.
+func (r *ArgonautReconciler) deleteReplacedArgoTunnel(ctx context.Context, cfc *cloudflare.API, host *tunnelHost, id string, creds *tunnelCredentials) error {
+	old, err := r.GetArgoTunnelByID(ctx, cfc, id)
+	if err != nil {
+		return err
+	}
+	if len(old.ID) == 0 || creds.Adopted {
+		return nil
+	}
+	if err := cfc.CleanupArgoTunnelConnections(ctx, cfc.AccountID, old.ID); err != nil {
+		return err
+	}
+	if err := r.DeleteArgoTunnel(ctx, cfc, &old); err != nil {
+		return err
+	}
+	r.Recorder.Eventf(host.Owner, v1.EventTypeNormal, eventTunnelDeleted, "Deleted replaced Argo Tunnel %s (%s)", old.Name, old.ID)
+	return nil
+}
+
+// Checks that every replica of the Deployment runs a pod template for the given tunnel.
+func deploymentRolledOut(deployment *appsv1.Deployment, tunnelID string) bool {
+	if deployment.Spec.Template.Annotations[tunnelIDAnnotation] != tunnelID {
+		return false
+	}
+	if deployment.Status.ObservedGeneration < deployment.Generation {
+		return false
+	}
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	return deployment.Status.UpdatedReplicas == replicas &&
+		deployment.Status.Replicas == replicas &&
+		deployment.Status.AvailableReplicas == replicas
+}
@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cloudflare/cloudflare-go"
+	argonautv1 "github.com/laetho/argonaut/api/v1beta1"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Services, Endpoints and the cloudflared Deployment change far more often than anything we keep
+// in Cloudflare. To spare the API, a tunnel we have seen and DNS we have published are trusted
+// for a while as long as what we would render for them stays the same.
+const cloudflareResync = 10 * time.Minute
+
+// What was last seen at or written to Cloudflare: tunnel names by ID, or for DNS a sum of what the
+// records were rendered from by Argonaut UID.
+type syncCache struct {
+	mu      sync.Mutex
+	entries map[string]syncEntry
+}
+
+type syncEntry struct {
+	sum    string
+	synced time.Time
+}
+
+// The sum stored for key, unless it is older than cloudflareResync.
+func (c *syncCache) lookup(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Since(entry.synced) >= cloudflareResync {
+		return "", false
+	}
+	return entry.sum, true
+}
+
+// Whether the entry for key has the given sum and is younger than cloudflareResync.
+func (c *syncCache) fresh(key string, sum string) bool {
+	stored, ok := c.lookup(key)
+	return ok && stored == sum
+}
+
+func (c *syncCache) store(key string, sum string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]syncEntry)
+	}
+	c.entries[key] = syncEntry{sum: sum, synced: time.Now()}
+}
+
+func (c *syncCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// Sum of everything the DNS records of an Argonaut are made from: the tunnel, the hostnames with
+// their record settings and the policies deciding what we may touch.
+func (r *ArgonautReconciler) dnsSum(argonaut *argonautv1.Argonaut, tun *cloudflare.ArgoTunnel, hostnames []string) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n%s\n", tun.ID, r.argonautOwner(argonaut), dnsPolicy(argonaut), argonaut.Spec.OwnershipPolicy, argonaut.Spec.ConflictPolicy)
+	for _, hostname := range hostnames {
+		record, _ := json.Marshal(desiredDNSRecord(argonaut, hostname, tun))
+		h.Write(record)
+		h.Write([]byte("\n"))
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// Whether the DNS status of an Argonaut shows every one of the hostnames published.
+func dnsPublished(argonaut *argonautv1.Argonaut, hostnames []string) bool {
+	if len(argonaut.Status.Hostnames) != len(hostnames) {
+		return false
+	}
+	for i, status := range argonaut.Status.Hostnames {
+		if !strings.EqualFold(status.Hostname, hostnames[i]) {
+			return false
+		}
+		if len(status.Reason) != 0 && status.Reason != reasonRecordConflictSkipped {
+			return false
+		}
+	}
+	return true
+}
@@ -2,53 +2,111 @@ package controllers
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"github.com/cloudflare/cloudflare-go"
 	"github.com/ghodss/yaml"
 	argonautv1 "github.com/laetho/argonaut/api/v1beta1"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/json"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sort"
 	"strconv"
+	"strings"
 )
 
-// Ensures that the Cloudflare Argo Tunnel exists. Will be created if does not exist.
-// The Argo Tunnel name will be the name of the Argonaut resource.
-func (r *ArgonautReconciler) ReconcileArgoTunnel(ctx context.Context, cfc *cloudflare.API, argonaut *argonautv1.Argonaut) (*cloudflare.ArgoTunnel, error) {
-
-	tun, err := r.GetArgoTunnel(ctx, cfc, argonaut)
+// Ensures that the Cloudflare Argo Tunnel exists. Will be created if does not exist, unless the
+// credentials were brought through argoTunnelSecret in which case that tunnel is adopted.
+// The credentials are the source of truth for which tunnel the cloudflared Deployment runs.
+// Returns that tunnel and where cloudflared finds its credentials.
+func (r *ArgonautReconciler) ReconcileArgoTunnel(ctx context.Context, cfc *cloudflare.API, host *tunnelHost) (*cloudflare.ArgoTunnel, *tunnelCredentials, error) {
+	creds, err := r.GetArgonautTunnelCredentials(ctx, host)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// Write TunnelId to Status
-	if tun.ID != argonaut.Status.TunnelId {
-		argonaut.Status.TunnelId = tun.ID
+	var tun cloudflare.ArgoTunnel
+	if name, ok := r.tunnelsSeen.lookup(creds.TunnelID); ok && creds.TunnelID == host.Status.TunnelId {
+		// Still running the tunnel DNS points at, which we looked up a moment ago.
+		tun = cloudflare.ArgoTunnel{ID: creds.TunnelID, Name: name}
+		if len(creds.TunnelName) == 0 {
+			creds.TunnelName = name
+		}
+	} else if len(creds.TunnelID) != 0 {
+		tun, err = r.GetArgoTunnelByID(ctx, cfc, creds.TunnelID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(tun.ID) == 0 {
+			if creds.Adopted {
+				return nil, nil, fmt.Errorf("%s: %s", errTunnelNotFound, creds.TunnelID)
+			}
+			log.FromContext(ctx).Info("Argo Tunnel from credentials no longer exists", "id", creds.TunnelID)
+			creds.ArgonautTunnelSecret = ArgonautTunnelSecret{}
+		} else {
+			if len(creds.TunnelName) == 0 {
+				// Tokens don't carry the tunnel name.
+				creds.TunnelName = tun.Name
+			}
+			r.tunnelsSeen.store(tun.ID, tun.Name)
+		}
 	}
 
-	if len(tun.ID) == 0 {
-		// Create Tunnel
-		tun, err = r.CreateArgoTunnel(ctx, cfc, argonaut)
+	if len(creds.TunnelID) == 0 {
+		tun, err = r.GetArgoTunnel(ctx, cfc, host.TunnelName)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		if len(tun.ID) != 0 {
+			// Without the secret we can't produce credentials for cloudflared.
+			return nil, nil, fmt.Errorf("%s: tunnel %s (%s), secret %s/%s", errTunnelCredentialsMissing, tun.Name, tun.ID, host.Namespace, creds.SecretName)
 		}
+		tun, creds.ArgonautTunnelSecret, err = r.CreateArgoTunnel(ctx, cfc, host.TunnelName)
+		if err != nil {
+			return nil, nil, err
+		}
+		r.Recorder.Eventf(host.Owner, v1.EventTypeNormal, eventTunnelCreated, "Created Argo Tunnel %s (%s)", tun.Name, tun.ID)
 	}
-	// Create ConfigMap, will be mapped into Pod
-	if err := r.ReconcileArgonautTunnelSecret(ctx, argonaut, &tun, cfc.AccountID); err != nil {
-		return &cloudflare.ArgoTunnel{}, err
+
+	// The first tunnel we see is the one DNS points at. From then on it only changes when
+	// cloudflared moves to another tunnel, see SwitchArgoTunnel.
+	if len(host.Status.TunnelId) == 0 {
+		if creds.Adopted {
+			r.Recorder.Eventf(host.Owner, v1.EventTypeNormal, eventTunnelAdopted, "Adopted Argo Tunnel %s (%s) from Secret %s", tun.Name, tun.ID, creds.SecretName)
+		}
+		host.Status.TunnelId = tun.ID
 	}
-	// Create Secret, will be mapped into Pod
-	if err := r.ReconcileArgonautTunnelConfig(ctx, argonaut, &tun); err != nil {
-		return &cloudflare.ArgoTunnel{}, err
+
+	if rotation, ok := host.Owner.GetAnnotations()[rotateTunnelSecretAnnotation]; ok && rotation != host.Status.TunnelSecretRotation && tun.ID == host.Status.TunnelId {
+		if creds.Adopted {
+			log.FromContext(ctx).Info("not rotating secret of adopted tunnel, update argoTunnelSecret instead", "tunnel", tun.Name)
+		} else {
+			log.FromContext(ctx).Info("rotating tunnel secret, creating replacement tunnel", "tunnel", tun.Name, "rotation", rotation)
+			tun, creds.ArgonautTunnelSecret, err = r.CreateArgoTunnel(ctx, cfc, rotatedTunnelName(host.TunnelName))
+			if err != nil {
+				return nil, nil, err
+			}
+			r.Recorder.Eventf(host.Owner, v1.EventTypeNormal, eventTunnelCreated, "Created Argo Tunnel %s (%s) to rotate the tunnel secret", tun.Name, tun.ID)
+		}
+		host.Status.TunnelSecretRotation = rotation
 	}
 
-	return &tun, nil
+	// Create Secret, will be mapped into Pod
+	if creds.Managed {
+		if err := r.ReconcileArgonautTunnelSecret(ctx, host, creds); err != nil {
+			return nil, nil, err
+		}
+	}
+	return &tun, creds, nil
 }
 
-// Fetch a Argo Tunnel from the Cloudflare API.
-func (r *ArgonautReconciler) GetArgoTunnel(ctx context.Context, cfc *cloudflare.API, argonaut *argonautv1.Argonaut) (cloudflare.ArgoTunnel, error) {
+// Fetch a Argo Tunnel from the Cloudflare API by name.
+func (r *ArgonautReconciler) GetArgoTunnel(ctx context.Context, cfc *cloudflare.API, name string) (cloudflare.ArgoTunnel, error) {
 
 	tuns, err := cfc.ArgoTunnels(ctx, cfc.AccountID)
 	if err != nil {
@@ -56,70 +114,168 @@ func (r *ArgonautReconciler) GetArgoTunnel(ctx context.Context, cfc *cloudflare.
 	}
 
 	for _, tun := range tuns {
-		if tun.Name == argonaut.Spec.ArgoTunnelName {
-			tunnel, _ := cfc.ArgoTunnel(ctx, cfc.AccountID, tun.ID)
-			fmt.Println("TUNNEL:", tunnel)
-			return tunnel, nil
+		// Deleted tunnels are still listed by the API, skip them.
+		if tun.DeletedAt != nil {
+			continue
+		}
+		if tun.Name == name {
+			return r.GetArgoTunnelByID(ctx, cfc, tun.ID)
 		}
 	}
 
 	return cloudflare.ArgoTunnel{}, nil
 }
 
-// Create a Argo Tunnel using the Cloudflare API
-func (r *ArgonautReconciler) CreateArgoTunnel(ctx context.Context, cfc *cloudflare.API, argonaut *argonautv1.Argonaut) (cloudflare.ArgoTunnel, error) {
-
-	tun, err := cfc.CreateArgoTunnel(ctx, cfc.AccountID, argonaut.Spec.ArgoTunnelName, base64.StdEncoding.EncodeToString([]byte("SuperSecretStringGeneratorHere")))
+// Fetch a Argo Tunnel from the Cloudflare API by ID. Returns an empty tunnel if it does not
+// exist or has been deleted.
+func (r *ArgonautReconciler) GetArgoTunnelByID(ctx context.Context, cfc *cloudflare.API, id string) (cloudflare.ArgoTunnel, error) {
+	if len(id) == 0 {
+		return cloudflare.ArgoTunnel{}, nil
+	}
+	tun, err := cfc.ArgoTunnel(ctx, cfc.AccountID, id)
+	if isCloudflareNotFound(err) {
+		return cloudflare.ArgoTunnel{}, nil
+	}
 	if err != nil {
 		return cloudflare.ArgoTunnel{}, err
 	}
-	tun.Secret = base64.StdEncoding.EncodeToString([]byte("SuperSecretStringGeneratorHere"))
+	if tun.DeletedAt != nil {
+		return cloudflare.ArgoTunnel{}, nil
+	}
 	return tun, nil
 }
 
-// Create or Update a Secret with TunnelID and TunnelSecret.
-func (r *ArgonautReconciler) ReconcileArgonautTunnelSecret(ctx context.Context, argonaut *argonautv1.Argonaut, tun *cloudflare.ArgoTunnel, account string) error {
+// Create a Argo Tunnel using the Cloudflare API with a freshly generated secret. Returns the
+// tunnel along with the credentials cloudflared needs to run it.
+func (r *ArgonautReconciler) CreateArgoTunnel(ctx context.Context, cfc *cloudflare.API, name string) (cloudflare.ArgoTunnel, ArgonautTunnelSecret, error) {
+	secret, err := generateTunnelSecret()
+	if err != nil {
+		return cloudflare.ArgoTunnel{}, ArgonautTunnelSecret{}, err
+	}
+
+	tun, err := cfc.CreateArgoTunnel(ctx, cfc.AccountID, name, secret)
+	if err != nil {
+		return cloudflare.ArgoTunnel{}, ArgonautTunnelSecret{}, err
+	}
+	tun.Secret = secret
+	log.FromContext(ctx).Info("created Argo Tunnel", "id", tun.ID, "name", tun.Name)
+
+	return tun, ArgonautTunnelSecret{
+		AccountTag:   cfc.AccountID,
+		TunnelSecret: secret,
+		TunnelID:     tun.ID,
+		TunnelName:   tun.Name,
+	}, nil
+}
+
+// Read the tunnel credentials for a tunnel. With argoTunnelSecret set they come from the
+// referenced Secret, as a credentials file or a tunnel token, and that Secret has to exist.
+// Otherwise they come from the operator managed Secret, and are empty until a tunnel is created.
+func (r *ArgonautReconciler) GetArgonautTunnelCredentials(ctx context.Context, host *tunnelHost) (*tunnelCredentials, error) {
+	ref := host.TunnelSecret
+	if len(ref.Namespace) != 0 && ref.Namespace != host.Namespace {
+		return nil, fmt.Errorf("argoTunnelSecret must be in the tunnel namespace %s, got %s", host.Namespace, ref.Namespace)
+	}
+
 	var secret v1.Secret
+	if len(ref.Name) == 0 {
+		creds := &tunnelCredentials{SecretName: host.TunnelName, SecretKey: "tunnel.json", Managed: true}
+		if err := r.Get(ctx, client.ObjectKey{Name: creds.SecretName, Namespace: host.Namespace}, &secret); err != nil {
+			return creds, client.IgnoreNotFound(err)
+		}
+		if payload, ok := secret.Data[creds.SecretKey]; ok {
+			if err := json.Unmarshal(payload, &creds.ArgonautTunnelSecret); err != nil {
+				log.FromContext(ctx).Error(err, "Unable to unmarshal tunnel.json from ArgonautTunnelSecret", "secret", secret.Name)
+				return nil, err
+			}
+		}
+		if len(creds.TunnelSecret) == 0 {
+			creds.ArgonautTunnelSecret = ArgonautTunnelSecret{}
+		}
+		return creds, nil
+	}
+
+	if err := r.Get(ctx, client.ObjectKey{Name: ref.Name, Namespace: host.Namespace}, &secret); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, fmt.Errorf("%s: %s/%s", errTunnelSecretNotFound, host.Namespace, ref.Name)
+		}
+		return nil, err
+	}
 
-	if err := r.Get(ctx, client.ObjectKey{Name: tun.Name, Namespace: argonaut.Namespace}, &secret); err != nil {
-		log.FromContext(ctx).Info("Argonaut tunnel secret not found, creating", "secret", argonaut.Name)
+	creds := &tunnelCredentials{SecretName: secret.Name, Adopted: true}
+	for _, key := range []string{"tunnel.json", "credentials.json"} {
+		if payload, ok := secret.Data[key]; ok {
+			if err := json.Unmarshal(payload, &creds.ArgonautTunnelSecret); err != nil {
+				return nil, fmt.Errorf("unable to unmarshal %s from Secret %s: %w", key, secret.Name, err)
+			}
+			creds.SecretKey = key
+			break
+		}
+	}
 
-		payload, err := json.Marshal(ArgonautTunnelSecret{
-			AccountTag:   account,
-			TunnelSecret: base64.StdEncoding.EncodeToString([]byte("SuperSecretStringGeneratorHere")),
-			TunnelID:     tun.ID,
-			TunnelName:   tun.Name,
-		})
+	if token, ok := secret.Data["token"]; ok && len(creds.SecretKey) == 0 {
+		payload, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(token)))
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("unable to decode tunnel token from Secret %s: %w", secret.Name, err)
+		}
+		var t ArgonautTunnelToken
+		if err := json.Unmarshal(payload, &t); err != nil {
+			return nil, fmt.Errorf("unable to unmarshal tunnel token from Secret %s: %w", secret.Name, err)
 		}
+		creds.ArgonautTunnelSecret = ArgonautTunnelSecret{
+			AccountTag:   t.AccountTag,
+			TunnelSecret: t.TunnelSecret,
+			TunnelID:     t.TunnelID,
+		}
+		// cloudflared wants a credentials file, which we keep next to the token Secret.
+		creds.SecretName = secret.Name + "-credentials"
+		creds.SecretKey = "tunnel.json"
+		creds.Managed = true
+	}
 
-		secret.Name = tun.Name
-		secret.Namespace = argonaut.Namespace
-		secret.StringData = make(map[string]string)
-		secret.StringData["tunnel.json"] = string(payload)
+	if len(creds.TunnelID) == 0 || len(creds.TunnelSecret) == 0 {
+		return nil, fmt.Errorf("%s: %s/%s", errTunnelSecretInvalid, host.Namespace, ref.Name)
+	}
+	return creds, nil
+}
 
-		if err := r.Create(ctx, &secret); err != nil {
+// Create or Update the operator managed Secret with the tunnel credentials. Leaves it alone if
+// nothing changed.
+func (r *ArgonautReconciler) ReconcileArgonautTunnelSecret(ctx context.Context, host *tunnelHost, creds *tunnelCredentials) error {
+	var secret v1.Secret
+
+	payload, err := json.Marshal(creds.ArgonautTunnelSecret)
+	if err != nil {
+		return err
+	}
+
+	if err := r.Get(ctx, client.ObjectKey{Name: creds.SecretName, Namespace: host.Namespace}, &secret); err != nil {
+		if !errors.IsNotFound(err) {
 			return err
 		}
-	} else {
-		var ts ArgonautTunnelSecret
+		log.FromContext(ctx).Info("Argonaut tunnel secret not found, creating", "secret", creds.SecretName)
 
-		err := json.Unmarshal(secret.Data["tunnel.json"], &ts)
-		if err != nil {
-			log.FromContext(ctx).Error(err, "Unable to unmarshal tunnel.json from ArgonautTunnelSecret", ts)
+		secret.Name = creds.SecretName
+		secret.Namespace = host.Namespace
+		secret.StringData = make(map[string]string)
+		secret.StringData[creds.SecretKey] = string(payload)
+		if err := r.setHostOwner(host, &secret); err != nil {
 			return err
 		}
 
-		payload, err := json.Marshal(ts)
-		if err != nil {
+		if err := r.Create(ctx, &secret); err != nil {
 			return err
 		}
+	} else {
+		if string(secret.Data[creds.SecretKey]) == string(payload) && metav1.IsControlledBy(&secret, host.Owner) {
+			return nil
+		}
 
-		secret.Name = tun.Name
-		secret.Namespace = argonaut.Namespace
 		secret.StringData = make(map[string]string)
-		secret.StringData["tunnel.json"] = string(payload)
+		secret.StringData[creds.SecretKey] = string(payload)
+		if err := r.setHostOwner(host, &secret); err != nil {
+			return err
+		}
 
 		if err := r.Update(ctx, &secret); err != nil {
 			return err
@@ -129,37 +285,47 @@ func (r *ArgonautReconciler) ReconcileArgonautTunnelSecret(ctx context.Context,
 	return nil
 }
 
-// Creates or updates a ConfigMap with the ArgoTunnel configuration.
-func (r *ArgonautReconciler) ReconcileArgonautTunnelConfig(ctx context.Context, argonaut *argonautv1.Argonaut, tun *cloudflare.ArgoTunnel) error {
+// Creates or updates a ConfigMap with the ArgoTunnel configuration. Leaves it alone if nothing
+// changed. Returns the rendered config.
+func (r *ArgonautReconciler) ReconcileArgonautTunnelConfig(ctx context.Context, host *tunnelHost, tun *cloudflare.ArgoTunnel) (string, error) {
 	var conf v1.ConfigMap
 
-	payload, err := yaml.Marshal(r.BuildArgonautTunnelConfig(ctx, argonaut, tun))
+	payload, err := yaml.Marshal(r.BuildArgonautTunnelConfig(ctx, host, tun))
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	if err := r.Get(ctx, client.ObjectKey{Name: argonaut.Name, Namespace: argonaut.Namespace}, &conf); err != nil {
-		log.FromContext(ctx).Info("Did not find ConfigMap, creating", "name", argonaut.Name)
-		conf.Name = argonaut.Name
-		conf.Namespace = argonaut.Namespace
+	if err := r.Get(ctx, client.ObjectKey{Name: host.Name, Namespace: host.Namespace}, &conf); err != nil {
+		log.FromContext(ctx).Info("Did not find ConfigMap, creating", "name", host.Name)
+		conf.Name = host.Name
+		conf.Namespace = host.Namespace
 		conf.Data = make(map[string]string)
 		conf.Data["config.yaml"] = string(payload)
+		if err := r.setHostOwner(host, &conf); err != nil {
+			return "", err
+		}
 
 		if err := r.Create(ctx, &conf); err != nil {
-			return err
+			return "", err
 		}
 	} else {
-		conf.Name = argonaut.Name
-		conf.Namespace = argonaut.Namespace
+		if conf.Data["config.yaml"] == string(payload) && metav1.IsControlledBy(&conf, host.Owner) {
+			return string(payload), nil
+		}
+
 		conf.Data = make(map[string]string)
 		conf.Data["config.yaml"] = string(payload)
+		if err := r.setHostOwner(host, &conf); err != nil {
+			return "", err
+		}
 
 		if err := r.Update(ctx, &conf); err != nil {
-			return err
+			return "", err
 		}
 		log.FromContext(ctx).Info("Updated ConfigMap", "name", conf.Name)
+		r.Recorder.Eventf(host.Owner, v1.EventTypeNormal, eventConfigUpdated, "Updated cloudflared config in ConfigMap %s/%s", conf.Namespace, conf.Name)
 	}
-	return nil
+	return string(payload), nil
 }
 
 // Deletes an Argo Tunnel using the Cloudflare API
@@ -167,43 +333,130 @@ func (r *ArgonautReconciler) DeleteArgoTunnel(ctx context.Context, cfc *cloudfla
 	if err := cfc.DeleteArgoTunnel(ctx, cfc.AccountID, tun.ID); err != nil {
 		return err
 	}
-	log.FromContext(ctx).Info("deleted Argo Tunnel", tun.ID, tun.Name)
+	r.tunnelsSeen.forget(tun.ID)
+	log.FromContext(ctx).Info("deleted Argo Tunnel", "id", tun.ID, "name", tun.Name)
 	return nil
 }
 
-// Builds the cloudflared config.yml from an Argonaut objekt with endpoint selectors etc.
-func (r *ArgonautReconciler) BuildArgonautTunnelConfig(ctx context.Context, argonaut *argonautv1.Argonaut, tun *cloudflare.ArgoTunnel) ArgonautTunnelConfig {
+// Generate a tunnel secret from 32 bytes of crypto/rand, base64 encoded as the API expects.
+func generateTunnelSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(secret), nil
+}
+
+// Tunnel names are unique per account, so a replacement tunnel gets a random suffix.
+func rotatedTunnelName(name string) string {
+	suffix := make([]byte, 3)
+	_, _ = rand.Read(suffix)
+	return name + "-" + hex.EncodeToString(suffix)
+}
+
+// Builds the cloudflared config.yml from Argonaut objekts with endpoint selectors etc. Rules
+// of several Argonauts sharing a tunnel are merged in order, each hostname only from the
+// Argonaut serving it, see hostnameOwners.
+func (r *ArgonautReconciler) BuildArgonautTunnelConfig(ctx context.Context, host *tunnelHost, tun *cloudflare.ArgoTunnel) ArgonautTunnelConfig {
 	conf := ArgonautTunnelConfig{
 		Tunnel:          tun.ID,
 		CredentialsFile: "/etc/cloudflare/tunnels/tunnel.json",
+		Metrics:         "0.0.0.0:" + strconv.Itoa(metricsPort),
 		Ingress:         nil,
 	}
 	var ingressConf []ArgonautTunnelConfigIngress
 
-	for _, ingress := range argonaut.Spec.Ingress {
-		var svc v1.ServiceList
-		err := r.List(ctx, &svc, client.MatchingLabels(ingress.ServiceSelector.MatchLabels))
-		if err != nil {
-			log.FromContext(ctx).Info("Found no Service matching selector", "selector", ingress.ServiceSelector)
-		}
-
-		// Find ClusterIP and Ports for each Service and create a ArgonautTunnelConfigIngress
-		// This one is very naive, and should be changed
-		for _, service := range svc.Items {
-			clusterip := service.Spec.ClusterIP
-			port := strconv.Itoa(int(service.Spec.Ports[0].Port))
-			protocol := "http://"
+	owners := hostnameOwners(host.Argonauts)
+	for _, argonaut := range host.Argonauts {
+		for _, ingress := range argonaut.Spec.Ingress {
+			if !ownsHostname(owners, &argonaut, ingress.Hostname) {
+				log.FromContext(ctx).Info("leaving out rule for hostname served by another Argonaut", "argonaut", argonaut.Name, "namespace", argonaut.Namespace, "hostname", ingress.Hostname)
+				continue
+			}
+			origin := originRequestConfig(argonaut.Spec.OriginRequest, ingress.OriginRequest)
+			if host.Shared() && len(caPoolPath(origin)) != 0 {
+				log.FromContext(ctx).Info("leaving out rule with caPool on shared tunnel", "argonaut", argonaut.Name, "namespace", argonaut.Namespace, "hostname", ingress.Hostname)
+				continue
+			}
+			if why, missing := host.MissingCABundles[caPoolPath(origin)]; missing {
+				log.FromContext(ctx).Info("leaving out rule with missing CA bundle", "argonaut", argonaut.Name, "namespace", argonaut.Namespace, "hostname", ingress.Hostname, "reason", why)
+				continue
+			}
+			backend := r.ResolveIngressRule(ctx, &argonaut, ingress)
+			if len(backend.Service) == 0 {
+				continue
+			}
 			ingressConf = append(ingressConf, ArgonautTunnelConfigIngress{
-				Hostname: ingress.Hostname,
-				Service:  protocol + clusterip + ":" + port,
+				Hostname:      ingress.Hostname,
+				Path:          ingress.Path,
+				Service:       backend.Service,
+				OriginRequest: origin,
 			})
 		}
 	}
+	sortIngressConfig(ingressConf)
 
-	ingressConf = append(ingressConf, ArgonautTunnelConfigIngress{
-		Service: "http_status:404",
-	})
+	ingressConf = append(ingressConf, r.defaultBackendConfig(ctx, host))
 	conf.Ingress = ingressConf
 
 	return conf
 }
+
+// Orders cloudflared ingress rules so the most specific match comes first, as cloudflared uses the
+// first rule matching a request. Exact hostnames go before wildcards and rules without a
+// hostname, and for the same hostname longer paths before shorter ones and any path before none.
+// Rules that tie keep their order.
+func sortIngressConfig(rules []ArgonautTunnelConfigIngress) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		a, b := rules[i], rules[j]
+		if ea, eb := len(a.Hostname) == 0, len(b.Hostname) == 0; ea != eb {
+			return eb
+		}
+		if wa, wb := strings.HasPrefix(a.Hostname, "*"), strings.HasPrefix(b.Hostname, "*"); wa != wb {
+			return wb
+		}
+		if a.Hostname != b.Hostname {
+			return a.Hostname < b.Hostname
+		}
+		if len(a.Path) != len(b.Path) {
+			return len(a.Path) > len(b.Path)
+		}
+		return false
+	})
+}
+
+// The catch-all rule closing the cloudflared config. cloudflared insists on one, so we answer 404
+// if the default backend is not set or does not resolve.
+func (r *ArgonautReconciler) defaultBackendConfig(ctx context.Context, host *tunnelHost) ArgonautTunnelConfigIngress {
+	notFound := ArgonautTunnelConfigIngress{Service: "http_status:404"}
+	if host.DefaultBackend == nil {
+		return notFound
+	}
+
+	// Resolved as a rule of an Argonaut living where cloudflared runs.
+	owner := &argonautv1.Argonaut{ObjectMeta: metav1.ObjectMeta{Name: host.Name, Namespace: host.Namespace}}
+	rule := host.DefaultBackend.Rule()
+	switch rule.Protocol {
+	case argonautv1.ProtocolHTTPStatus, argonautv1.ProtocolHelloWorld, argonautv1.ProtocolUnix:
+	default:
+		if rule.ServiceRef == nil {
+			// The catch-all must never be whatever Service happens to sort first.
+			log.FromContext(ctx).Info("default backend has a protocol but no serviceRef, answering 404", "name", host.Name)
+			return notFound
+		}
+	}
+	origin := originRequestConfig(nil, rule.OriginRequest)
+	if why, missing := host.MissingCABundles[caPoolPath(origin)]; missing {
+		log.FromContext(ctx).Info("default backend has a missing CA bundle, answering 404", "name", host.Name, "reason", why)
+		return notFound
+	}
+	backend := r.ResolveIngressRule(ctx, owner, rule)
+	if len(backend.Service) == 0 {
+		log.FromContext(ctx).Info("default backend did not resolve, answering 404", "name", host.Name, "warning", backend.Warning)
+		return notFound
+	}
+	return ArgonautTunnelConfigIngress{
+		Service:       backend.Service,
+		OriginRequest: origin,
+	}
+}
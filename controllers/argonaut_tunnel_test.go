@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSortIngressConfig(t *testing.T) {
+	rule := func(hostname string, path string, service string) ArgonautTunnelConfigIngress {
+		return ArgonautTunnelConfigIngress{Hostname: hostname, Path: path, Service: service}
+	}
+	tests := []struct {
+		name  string
+		rules []ArgonautTunnelConfigIngress
+		want  []ArgonautTunnelConfigIngress
+	}{
+		{
+			name: "exact before wildcard before no hostname",
+			rules: []ArgonautTunnelConfigIngress{
+				rule("", "", "http://catch-all"),
+				rule("*.example.com", "", "http://wildcard"),
+				rule("app.example.com", "", "http://app"),
+			},
+			want: []ArgonautTunnelConfigIngress{
+				rule("app.example.com", "", "http://app"),
+				rule("*.example.com", "", "http://wildcard"),
+				rule("", "", "http://catch-all"),
+			},
+		},
+		{
+			name: "hostnames in lexical order",
+			rules: []ArgonautTunnelConfigIngress{
+				rule("web.example.com", "", "http://web"),
+				rule("*.b.example.com", "", "http://b"),
+				rule("api.example.com", "", "http://api"),
+				rule("*.a.example.com", "", "http://a"),
+			},
+			want: []ArgonautTunnelConfigIngress{
+				rule("api.example.com", "", "http://api"),
+				rule("web.example.com", "", "http://web"),
+				rule("*.a.example.com", "", "http://a"),
+				rule("*.b.example.com", "", "http://b"),
+			},
+		},
+		{
+			name: "longer paths first",
+			rules: []ArgonautTunnelConfigIngress{
+				rule("app.example.com", "", "http://root"),
+				rule("app.example.com", "/api", "http://api"),
+				rule("app.example.com", "/api/v2", "http://v2"),
+				rule("", "/health", "http://health"),
+				rule("", "", "http://catch-all"),
+			},
+			want: []ArgonautTunnelConfigIngress{
+				rule("app.example.com", "/api/v2", "http://v2"),
+				rule("app.example.com", "/api", "http://api"),
+				rule("app.example.com", "", "http://root"),
+				rule("", "/health", "http://health"),
+				rule("", "", "http://catch-all"),
+			},
+		},
+		{
+			name: "ties keep their order",
+			rules: []ArgonautTunnelConfigIngress{
+				rule("app.example.com", "/b", "http://first"),
+				rule("app.example.com", "/a", "http://second"),
+				rule("app.example.com", "/b", "http://third"),
+			},
+			want: []ArgonautTunnelConfigIngress{
+				rule("app.example.com", "/b", "http://first"),
+				rule("app.example.com", "/a", "http://second"),
+				rule("app.example.com", "/b", "http://third"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sortIngressConfig(tt.rules)
+			if !reflect.DeepEqual(tt.rules, tt.want) {
+				t.Errorf("sorted to %v, want %v", tt.rules, tt.want)
+			}
+		})
+	}
+}
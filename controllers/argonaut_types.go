@@ -12,11 +12,56 @@ type ArgonautTunnelSecret struct {
 type ArgonautTunnelConfig struct {
 	Tunnel          string                        `json:"tunnel"`
 	CredentialsFile string                        `json:"credentials-file"`
+	Metrics         string                        `json:"metrics,omitempty"`
 	Ingress         []ArgonautTunnelConfigIngress `json:"ingress"`
 }
 
 // Struct for holding ingress information
 type ArgonautTunnelConfigIngress struct {
-	Hostname string `json:"hostname,omitempty"`
-	Service  string `json:"service,omitempty"`
+	Hostname      string                             `json:"hostname,omitempty"`
+	Path          string                             `json:"path,omitempty"`
+	Service       string                             `json:"service,omitempty"`
+	OriginRequest *ArgonautTunnelConfigOriginRequest `json:"originRequest,omitempty"`
+}
+
+// Struct for the originRequest settings of an ingress rule
+type ArgonautTunnelConfigOriginRequest struct {
+	ConnectTimeout         string                      `json:"connectTimeout,omitempty"`
+	NoTLSVerify            *bool                       `json:"noTLSVerify,omitempty"`
+	OriginServerName       string                      `json:"originServerName,omitempty"`
+	CAPool                 string                      `json:"caPool,omitempty"`
+	HTTPHostHeader         string                      `json:"httpHostHeader,omitempty"`
+	KeepAliveConnections   *int                        `json:"keepAliveConnections,omitempty"`
+	DisableChunkedEncoding *bool                       `json:"disableChunkedEncoding,omitempty"`
+	ProxyType              string                      `json:"proxyType,omitempty"`
+	Access                 *ArgonautTunnelConfigAccess `json:"access,omitempty"`
+}
+
+// Struct for Cloudflare Access JWT validation settings
+type ArgonautTunnelConfigAccess struct {
+	Required bool     `json:"required,omitempty"`
+	TeamName string   `json:"teamName"`
+	AudTag   []string `json:"audTag,omitempty"`
+}
+
+// Payload of a cloudflared tunnel token, which is base64 encoded JSON.
+type ArgonautTunnelToken struct {
+	AccountTag   string `json:"a"`
+	TunnelSecret string `json:"s"`
+	TunnelID     string `json:"t"`
+}
+
+// Tunnel credentials along with the Secret cloudflared reads them from.
+type tunnelCredentials struct {
+	ArgonautTunnelSecret
+
+	// Secret mounted into cloudflared and the key holding the credentials file.
+	SecretName string
+	SecretKey  string
+
+	// Credentials were brought by the user through argoTunnelSecret, the tunnel is adopted.
+	Adopted bool
+
+	// The operator writes the Secret, either generated credentials or ones derived from a token.
+	Managed bool
 }
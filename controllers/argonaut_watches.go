@@ -0,0 +1,475 @@
+package controllers
+
+import (
+	"context"
+	argonautv1 "github.com/laetho/argonaut/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// Field index on Argonauts by spec.argoTunnelName.
+	argoTunnelNameField = ".spec.argoTunnelName"
+
+	// Field indexes on Argonauts by the labels their service and endpoints selectors require,
+	// see selectorIndexValues.
+	serviceSelectorField   = ".spec.ingress.serviceSelector"
+	endpointsSelectorField = ".spec.ingress.endpointsSelector"
+
+	// Field index on Argonauts and ArgoTunnels by the Services named in a serviceRef, as
+	// namespace/name.
+	serviceRefField = ".spec.ingress.serviceRef"
+
+	// Field index on Argonauts and ArgoTunnels by the Secrets they read, as namespace/name.
+	secretRefField = ".spec.secretRefs"
+
+	// Field index on Argonauts and ArgoTunnels by the ConfigMaps and Secrets named in a caPool,
+	// as kind/name. They live wherever cloudflared runs, so the namespace is left out.
+	caPoolField = ".spec.originRequest.caPool"
+)
+
+// Registers the field indexes used to map watched objects back to Argonauts and ArgoTunnels.
+func setupIndexes(ctx context.Context, mgr ctrl.Manager) error {
+	indexer := mgr.GetFieldIndexer()
+	if err := indexer.IndexField(ctx, &argonautv1.Argonaut{}, argoTunnelNameField, func(obj client.Object) []string {
+		return []string{obj.(*argonautv1.Argonaut).Spec.ArgoTunnelName}
+	}); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(ctx, &argonautv1.Argonaut{}, serviceSelectorField, func(obj client.Object) []string {
+		return selectorIndexValues(serviceSelectorRules(obj.(*argonautv1.Argonaut)), serviceSelectorOf)
+	}); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(ctx, &argonautv1.Argonaut{}, serviceRefField, func(obj client.Object) []string {
+		return serviceRefs(obj.(*argonautv1.Argonaut))
+	}); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(ctx, &argonautv1.Argonaut{}, endpointsSelectorField, func(obj client.Object) []string {
+		return selectorIndexValues(endpointsSelectorRules(obj.(*argonautv1.Argonaut)), endpointsSelectorOf)
+	}); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(ctx, &argonautv1.Argonaut{}, secretRefField, func(obj client.Object) []string {
+		return hostSecretRefs(argonautTunnelHost(obj.(*argonautv1.Argonaut)))
+	}); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(ctx, &argonautv1.Argonaut{}, caPoolField, func(obj client.Object) []string {
+		return caPoolRefs(uniqueCABundles(argonautOriginRequests(obj.(*argonautv1.Argonaut))))
+	}); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(ctx, &argonautv1.ArgoTunnel{}, caPoolField, func(obj client.Object) []string {
+		tunnel := obj.(*argonautv1.ArgoTunnel)
+		if tunnel.Spec.DefaultBackend == nil {
+			return nil
+		}
+		return caPoolRefs(uniqueCABundles([]*argonautv1.OriginRequest{tunnel.Spec.DefaultBackend.OriginRequest}))
+	}); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(ctx, &argonautv1.ArgoTunnel{}, serviceRefField, func(obj client.Object) []string {
+		tunnel := obj.(*argonautv1.ArgoTunnel)
+		if tunnel.Spec.DefaultBackend == nil {
+			return nil
+		}
+		return serviceRefValues(tunnel.Spec.DefaultBackend.ServiceRef, tunnel.Spec.Namespace)
+	}); err != nil {
+		return err
+	}
+	return indexer.IndexField(ctx, &argonautv1.ArgoTunnel{}, secretRefField, func(obj client.Object) []string {
+		return hostSecretRefs(argoTunnelHost(obj.(*argonautv1.ArgoTunnel), nil))
+	})
+}
+
+// Rules routing to Services through a serviceSelector, following the precedence of
+// ResolveIngressRule.
+func serviceSelectorRules(argonaut *argonautv1.Argonaut) []argonautv1.ArgonautIngressRule {
+	var rules []argonautv1.ArgonautIngressRule
+	for _, ingress := range argonaut.Spec.Ingress {
+		switch ingress.Protocol {
+		case argonautv1.ProtocolHTTPStatus, argonautv1.ProtocolHelloWorld, argonautv1.ProtocolUnix:
+			continue
+		}
+		if ingress.ServiceRef == nil && !selectorSet(ingress.EndpointsSelector) && selectorSet(ingress.ServiceSelector) {
+			rules = append(rules, ingress)
+		}
+	}
+	return rules
+}
+
+func serviceSelectorOf(ingress argonautv1.ArgonautIngressRule) metav1.LabelSelector {
+	return ingress.ServiceSelector
+}
+
+// Services named by the rules and default backend of an Argonaut, see serviceRefField.
+func serviceRefs(argonaut *argonautv1.Argonaut) []string {
+	var refs []string
+	for _, ingress := range argonaut.Spec.Ingress {
+		refs = append(refs, serviceRefValues(ingress.ServiceRef, argonaut.Namespace)...)
+	}
+	if argonaut.Spec.DefaultBackend != nil {
+		refs = append(refs, serviceRefValues(argonaut.Spec.DefaultBackend.ServiceRef, argonaut.Namespace)...)
+	}
+	return refs
+}
+
+// Index value for a serviceRef, if set. The namespace defaults to the given one.
+func serviceRefValues(ref *argonautv1.ArgonautServiceRef, namespace string) []string {
+	if ref == nil {
+		return nil
+	}
+	if len(ref.Namespace) != 0 {
+		namespace = ref.Namespace
+	}
+	return []string{objectRef(namespace, ref.Name)}
+}
+
+// Rules routing to Endpoints through an endpointsSelector.
+func endpointsSelectorRules(argonaut *argonautv1.Argonaut) []argonautv1.ArgonautIngressRule {
+	var rules []argonautv1.ArgonautIngressRule
+	for _, ingress := range argonaut.Spec.Ingress {
+		if endpointsRule(ingress) {
+			rules = append(rules, ingress)
+		}
+	}
+	return rules
+}
+
+func endpointsSelectorOf(ingress argonautv1.ArgonautIngressRule) metav1.LabelSelector {
+	return ingress.EndpointsSelector
+}
+
+// Index values for the selectors of a set of rules. A selector is indexed under a label it
+// requires: key=value for matchLabels and In, the bare key for Exists. Selectors requiring no
+// label at all, only NotIn or DoesNotExist, go under "*" and are looked at for every object.
+func selectorIndexValues(rules []argonautv1.ArgonautIngressRule, selectorOf func(argonautv1.ArgonautIngressRule) metav1.LabelSelector) []string {
+	var values []string
+	for _, ingress := range rules {
+		selector := selectorOf(ingress)
+		var required []string
+		for k, v := range selector.MatchLabels {
+			required = append(required, k+"="+v)
+		}
+		for _, expression := range selector.MatchExpressions {
+			switch expression.Operator {
+			case metav1.LabelSelectorOpIn:
+				for _, v := range expression.Values {
+					required = append(required, expression.Key+"="+v)
+				}
+			case metav1.LabelSelectorOpExists:
+				required = append(required, expression.Key)
+			}
+		}
+		if len(required) == 0 {
+			required = []string{"*"}
+		}
+		values = append(values, required...)
+	}
+	return values
+}
+
+// Secrets a tunnel reads or writes: the Cloudflare credentials, a referenced tunnel Secret and
+// the Secrets the operator manages for it.
+func hostSecretRefs(host *tunnelHost) []string {
+	refs := []string{objectRef(host.CFAuthSecret.Namespace, host.CFAuthSecret.Name)}
+	if len(host.TunnelSecret.Name) != 0 {
+		refs = append(refs,
+			objectRef(host.Namespace, host.TunnelSecret.Name),
+			objectRef(host.Namespace, host.TunnelSecret.Name+"-credentials"))
+	} else {
+		refs = append(refs, objectRef(host.Namespace, host.TunnelName))
+	}
+	return refs
+}
+
+// Index values for the ConfigMaps and Secrets of CA bundles, see caPoolField.
+func caPoolRefs(bundles []caBundle) []string {
+	var refs []string
+	for _, bundle := range bundles {
+		if len(bundle.ConfigMap) != 0 {
+			refs = append(refs, "ConfigMap/"+bundle.ConfigMap)
+		} else {
+			refs = append(refs, "Secret/"+bundle.Secret)
+		}
+	}
+	return refs
+}
+
+// Index value for an object reference, as namespace/name.
+func objectRef(namespace string, name string) string {
+	return namespace + "/" + name
+}
+
+// Finds the Argonauts with a rule selecting an object. Candidates come from the index, the full
+// selector and the namespaces the rule looks in are checked after.
+func (r *ArgonautReconciler) argonautsSelecting(field string, rules func(*argonautv1.Argonaut) []argonautv1.ArgonautIngressRule, selectorOf func(argonautv1.ArgonautIngressRule) metav1.LabelSelector, obj client.Object) []argonautv1.Argonaut {
+	set := labels.Set(obj.GetLabels())
+	candidates := make(map[types.NamespacedName]argonautv1.Argonaut)
+	values := []string{"*"}
+	for k, v := range set {
+		values = append(values, k, k+"="+v)
+	}
+	for _, value := range values {
+		var argonauts argonautv1.ArgonautList
+		if err := r.List(context.Background(), &argonauts, client.MatchingFields{field: value}); err != nil {
+			continue
+		}
+		for _, argonaut := range argonauts.Items {
+			candidates[types.NamespacedName{Name: argonaut.Name, Namespace: argonaut.Namespace}] = argonaut
+		}
+	}
+
+	var namespace *v1.Namespace
+	var matches []argonautv1.Argonaut
+	for _, argonaut := range candidates {
+		for _, ingress := range rules(&argonaut) {
+			selector := selectorOf(ingress)
+			sel, err := metav1.LabelSelectorAsSelector(&selector)
+			if err != nil || !sel.Matches(set) {
+				continue
+			}
+			if ingress.NamespaceSelector == nil {
+				if obj.GetNamespace() != argonaut.Namespace {
+					continue
+				}
+			} else {
+				if namespace == nil {
+					// A namespace we can't get is matched as if it had no labels.
+					namespace = &v1.Namespace{}
+					_ = r.Get(context.Background(), client.ObjectKey{Name: obj.GetNamespace()}, namespace)
+				}
+				nsSel, err := metav1.LabelSelectorAsSelector(ingress.NamespaceSelector)
+				if err != nil || !nsSel.Matches(labels.Set(namespace.Labels)) {
+					continue
+				}
+			}
+			matches = append(matches, argonaut)
+			break
+		}
+	}
+	return matches
+}
+
+// Finds the Argonauts routing to a Service, by selector or by name.
+func (r *ArgonautReconciler) argonautsRoutingTo(obj client.Object) []argonautv1.Argonaut {
+	argonauts := r.argonautsSelecting(serviceSelectorField, serviceSelectorRules, serviceSelectorOf, obj)
+	var named argonautv1.ArgonautList
+	if err := r.List(context.Background(), &named, client.MatchingFields{serviceRefField: objectRef(obj.GetNamespace(), obj.GetName())}); err == nil {
+		argonauts = append(argonauts, named.Items...)
+	}
+	return argonauts
+}
+
+// Maps a Service to the Argonauts routing to it.
+func (r *ArgonautReconciler) argonautsForService(obj client.Object) []reconcile.Request {
+	return argonautRequests(r.argonautsRoutingTo(obj))
+}
+
+// Maps Endpoints to the Argonauts routing to them, or to the headless Service they belong to.
+func (r *ArgonautReconciler) argonautsForEndpoints(obj client.Object) []reconcile.Request {
+	argonauts := r.argonautsSelecting(endpointsSelectorField, endpointsSelectorRules, endpointsSelectorOf, obj)
+	if service := r.headlessServiceOf(obj); service != nil {
+		argonauts = append(argonauts, r.argonautsRoutingTo(service)...)
+	}
+	return argonautRequests(argonauts)
+}
+
+// The headless Service of Endpoints, if it takes the port of a named target port from them, see
+// headlessTargetPort. Returns nil for other Services, their origin does not depend on Endpoints.
+func (r *ArgonautReconciler) headlessServiceOf(obj client.Object) *v1.Service {
+	var service v1.Service
+	if err := r.Get(context.Background(), client.ObjectKey{Name: obj.GetName(), Namespace: obj.GetNamespace()}, &service); err != nil {
+		return nil
+	}
+	if service.Spec.ClusterIP != v1.ClusterIPNone {
+		return nil
+	}
+	for _, port := range service.Spec.Ports {
+		if port.TargetPort.Type == intstr.String && len(port.TargetPort.StrVal) != 0 {
+			return &service
+		}
+	}
+	return nil
+}
+
+// Maps a Secret to the Argonauts reading it, directly or as a CA bundle.
+func (r *ArgonautReconciler) argonautsForSecret(obj client.Object) []reconcile.Request {
+	argonauts := r.argonautsWithCAPool("Secret", obj)
+	var list argonautv1.ArgonautList
+	if err := r.List(context.Background(), &list, client.MatchingFields{secretRefField: objectRef(obj.GetNamespace(), obj.GetName())}); err == nil {
+		argonauts = append(argonauts, list.Items...)
+	}
+	return argonautRequests(argonauts)
+}
+
+// Maps a ConfigMap to the Argonauts using it as a CA bundle.
+func (r *ArgonautReconciler) argonautsForConfigMap(obj client.Object) []reconcile.Request {
+	return argonautRequests(r.argonautsWithCAPool("ConfigMap", obj))
+}
+
+// Argonauts with a caPool naming a ConfigMap or Secret by the name of the object.
+func (r *ArgonautReconciler) argonautsWithCAPool(kind string, obj client.Object) []argonautv1.Argonaut {
+	var argonauts argonautv1.ArgonautList
+	if err := r.List(context.Background(), &argonauts, client.MatchingFields{caPoolField: kind + "/" + obj.GetName()}); err != nil {
+		return nil
+	}
+	return argonauts.Items
+}
+
+// Maps an ArgoTunnel to reconcile requests for the Argonauts referencing it.
+func (r *ArgonautReconciler) argonautsForArgoTunnel(obj client.Object) []reconcile.Request {
+	var argonauts argonautv1.ArgonautList
+	if err := r.List(context.Background(), &argonauts, client.MatchingFields{argoTunnelNameField: obj.GetName()}); err != nil {
+		return nil
+	}
+	return argonautRequests(argonauts.Items)
+}
+
+// Maps a ServiceGrant to the Argonauts in the namespaces it lets in.
+func (r *ArgonautReconciler) argonautsForServiceGrant(obj client.Object) []reconcile.Request {
+	return argonautRequests(r.argonautsGranted(obj.(*argonautv1.ServiceGrant)))
+}
+
+// Argonauts in the namespaces a ServiceGrant lets in.
+func (r *ArgonautReconciler) argonautsGranted(grant *argonautv1.ServiceGrant) []argonautv1.Argonaut {
+	var argonauts []argonautv1.Argonaut
+	for _, from := range grant.Spec.From {
+		var list argonautv1.ArgonautList
+		if err := r.List(context.Background(), &list, client.InNamespace(from.Namespace)); err != nil {
+			continue
+		}
+		argonauts = append(argonauts, list.Items...)
+	}
+	return argonauts
+}
+
+func argonautRequests(argonauts []argonautv1.Argonaut) []reconcile.Request {
+	var requests []reconcile.Request
+	for _, argonaut := range argonauts {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: argonaut.Name, Namespace: argonaut.Namespace}})
+	}
+	return requests
+}
+
+// Maps a Service to the ArgoTunnels whose Argonauts route to it, or using it as default backend.
+func (r *ArgoTunnelReconciler) argoTunnelsForService(obj client.Object) []reconcile.Request {
+	requests := argoTunnelRequests(r.argonautsRoutingTo(obj))
+	var tunnels argonautv1.ArgoTunnelList
+	if err := r.List(context.Background(), &tunnels, client.MatchingFields{serviceRefField: objectRef(obj.GetNamespace(), obj.GetName())}); err == nil {
+		for _, tunnel := range tunnels.Items {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: tunnel.Name}})
+		}
+	}
+	return requests
+}
+
+// Maps Endpoints to the ArgoTunnels whose Argonauts route to them, or to the headless Service they
+// belong to, and those using that Service as default backend.
+func (r *ArgoTunnelReconciler) argoTunnelsForEndpoints(obj client.Object) []reconcile.Request {
+	requests := argoTunnelRequests(r.argonautsSelecting(endpointsSelectorField, endpointsSelectorRules, endpointsSelectorOf, obj))
+	if service := r.headlessServiceOf(obj); service != nil {
+		requests = append(requests, r.argoTunnelsForService(service)...)
+	}
+	return requests
+}
+
+// Maps a ServiceGrant to the ArgoTunnels of the Argonauts in the namespaces it lets in.
+func (r *ArgoTunnelReconciler) argoTunnelsForServiceGrant(obj client.Object) []reconcile.Request {
+	return argoTunnelRequests(r.argonautsGranted(obj.(*argonautv1.ServiceGrant)))
+}
+
+// Maps a Secret to the ArgoTunnels reading it, directly or as a CA bundle.
+func (r *ArgoTunnelReconciler) argoTunnelsForSecret(obj client.Object) []reconcile.Request {
+	requests := r.argoTunnelsWithCAPool("Secret", obj)
+	var tunnels argonautv1.ArgoTunnelList
+	if err := r.List(context.Background(), &tunnels, client.MatchingFields{secretRefField: objectRef(obj.GetNamespace(), obj.GetName())}); err != nil {
+		return requests
+	}
+	for _, tunnel := range tunnels.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: tunnel.Name}})
+	}
+	return requests
+}
+
+// Maps a ConfigMap to the ArgoTunnels using it as a CA bundle.
+func (r *ArgoTunnelReconciler) argoTunnelsForConfigMap(obj client.Object) []reconcile.Request {
+	return r.argoTunnelsWithCAPool("ConfigMap", obj)
+}
+
+// ArgoTunnels with a caPool naming a ConfigMap or Secret by the name of the object. Those of their
+// Argonauts are never mounted, see markSharedCAPools.
+func (r *ArgoTunnelReconciler) argoTunnelsWithCAPool(kind string, obj client.Object) []reconcile.Request {
+	var requests []reconcile.Request
+	var tunnels argonautv1.ArgoTunnelList
+	if err := r.List(context.Background(), &tunnels, client.MatchingFields{caPoolField: kind + "/" + obj.GetName()}); err != nil {
+		return requests
+	}
+	for _, tunnel := range tunnels.Items {
+		if tunnel.Spec.Namespace == obj.GetNamespace() {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: tunnel.Name}})
+		}
+	}
+	return requests
+}
+
+// Maps an Argonaut to the ArgoTunnel it references. The request is dropped if there is no such
+// ArgoTunnel.
+func argoTunnelForArgonaut(obj client.Object) []reconcile.Request {
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: obj.(*argonautv1.Argonaut).Spec.ArgoTunnelName}}}
+}
+
+func argoTunnelRequests(argonauts []argonautv1.Argonaut) []reconcile.Request {
+	seen := make(map[string]bool)
+	var requests []reconcile.Request
+	for _, argonaut := range argonauts {
+		if seen[argonaut.Spec.ArgoTunnelName] {
+			continue
+		}
+		seen[argonaut.Spec.ArgoTunnelName] = true
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: argonaut.Spec.ArgoTunnelName}})
+	}
+	return requests
+}
+
+// Only passes Service updates that change where cloudflared would send traffic. The ClusterIP
+// matters as it tells headless Services apart.
+var serviceChangedPredicate = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		old, ok := e.ObjectOld.(*v1.Service)
+		if !ok {
+			return true
+		}
+		svc := e.ObjectNew.(*v1.Service)
+		return !equality.Semantic.DeepEqual(old.Labels, svc.Labels) ||
+			old.Spec.Type != svc.Spec.Type ||
+			old.Spec.ClusterIP != svc.Spec.ClusterIP ||
+			old.Spec.ExternalName != svc.Spec.ExternalName ||
+			!equality.Semantic.DeepEqual(old.Spec.Ports, svc.Spec.Ports)
+	},
+}
+
+// Passes Deployment updates that change spec or status, metadata changes made by others don't
+// concern us.
+var deploymentChangedPredicate = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		old, ok := e.ObjectOld.(*appsv1.Deployment)
+		if !ok {
+			return true
+		}
+		deployment := e.ObjectNew.(*appsv1.Deployment)
+		return old.Generation != deployment.Generation || !equality.Semantic.DeepEqual(old.Status, deployment.Status)
+	},
+}
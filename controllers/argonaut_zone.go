@@ -2,34 +2,137 @@ package controllers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"github.com/cloudflare/cloudflare-go"
-	argonautv1 "github.com/laetho/argonaut/api/v1beta1"
+	"net/http"
+	"net/url"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"strconv"
 	"strings"
-	//	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sync"
+	"time"
 )
 
-// Reconcile Zones
-func (r *ArgonautReconciler) ReconcileZone(ctx context.Context, cfc *cloudflare.API, argonaut *argonautv1.Argonaut) (string, error) {
-	zoneid, err := r.ZoneExists(ctx, cfc, HostnameToZone(argonaut.Spec.Ingress[0].Hostname))
+const (
+	// How long the zone list of an account is trusted.
+	zoneCacheTTL = 5 * time.Minute
+	// How old the zone list may be before a hostname without a zone triggers a fresh look.
+	zoneCacheRetry = 30 * time.Second
+	// Page size when listing zones, the most the API hands out at once.
+	zonesPerPage = 50
+)
+
+// Zone names and IDs per Cloudflare account and token. Saves listing every zone on each
+// reconcile. Tokens of one account may see different zones, so each gets its own list.
+type zoneCache struct {
+	mu       sync.Mutex
+	accounts map[string]accountZones
+}
+
+type accountZones struct {
+	// Zone IDs by zone name.
+	zones   map[string]string
+	fetched time.Time
+}
+
+// Zone IDs by name of every zone of the account the credentials can see. Served from cache unless
+// it is older than maxAge.
+func (r *ArgonautReconciler) Zones(ctx context.Context, cfc *cloudflare.API, maxAge time.Duration) (map[string]string, error) {
+	r.zones.mu.Lock()
+	defer r.zones.mu.Unlock()
+
+	key := zoneCacheKey(cfc)
+	if cached, ok := r.zones.accounts[key]; ok && time.Since(cached.fetched) < maxAge {
+		return cached.zones, nil
+	}
+
+	list, err := listZones(ctx, cfc)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	zones := make(map[string]string, len(list))
+	for _, zone := range list {
+		zones[strings.ToLower(zone.Name)] = zone.ID
+	}
+	if r.zones.accounts == nil {
+		r.zones.accounts = make(map[string]accountZones)
 	}
-	return zoneid, nil
+	r.zones.accounts[key] = accountZones{zones: zones, fetched: time.Now()}
+	log.FromContext(ctx).Info("Fetched Cloudflare zones", "count", len(zones))
+	return zones, nil
 }
 
-// Check if a DNS Zone exists.
-func (r *ArgonautReconciler) ZoneExists(ctx context.Context, cfc *cloudflare.API, name string) (string, error) {
-	zoneid, err := cfc.ZoneIDByName(name)
+// Cache key for the zones the credentials of a client see. The token is hashed so it does not
+// linger in memory any longer than the client does.
+func zoneCacheKey(cfc *cloudflare.API) string {
+	sum := sha256.Sum256([]byte(cfc.APIToken + "\x00" + cfc.APIKey + "\x00" + cfc.APIEmail))
+	return cfc.AccountID + "/" + hex.EncodeToString(sum[:8])
+}
+
+// Lists the zones of the account of a client, or every zone the credentials see if the client
+// has no account. cloudflare-go does not filter ListZones by account.
+func listZones(ctx context.Context, cfc *cloudflare.API) ([]cloudflare.Zone, error) {
+	v := url.Values{}
+	v.Set("per_page", strconv.Itoa(zonesPerPage))
+	if len(cfc.AccountID) != 0 {
+		v.Set("account.id", cfc.AccountID)
+	}
+
+	var zones []cloudflare.Zone
+	for page := 1; ; page++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		v.Set("page", strconv.Itoa(page))
+		res, err := cfc.Raw(http.MethodGet, fmt.Sprintf("/zones?%s", v.Encode()), nil)
+		if err != nil {
+			return nil, err
+		}
+		var batch []cloudflare.Zone
+		if err := json.Unmarshal(res, &batch); err != nil {
+			return nil, err
+		}
+		zones = append(zones, batch...)
+		if len(batch) < zonesPerPage {
+			return zones, nil
+		}
+	}
+}
+
+// Finds the zone a hostname belongs to. Returns empty name and ID if the account has no zone for
+// it.
+func (r *ArgonautReconciler) ZoneForHostname(ctx context.Context, cfc *cloudflare.API, hostname string) (string, string, error) {
+	zones, err := r.Zones(ctx, cfc, zoneCacheTTL)
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+	if name, id := hostnameZone(zones, hostname); len(id) != 0 {
+		return name, id, nil
 	}
-	return zoneid, nil
+	// The zone may have been added since we last looked.
+	zones, err = r.Zones(ctx, cfc, zoneCacheRetry)
+	if err != nil {
+		return "", "", err
+	}
+	name, id := hostnameZone(zones, hostname)
+	return name, id, nil
 }
 
-// Helper function to turn a hostname into a Zone. Example blah.example.com into example.com.
-func HostnameToZone(hostname string) (zone string) {
-	parts := strings.Split(hostname, ".")
-	nparts := len(parts)
-	zone = parts[nparts-2] + "." + parts[nparts-1]
-	return
+// Walks the suffixes of a hostname, longest first, and returns the first that is a zone. So
+// app.example.co.uk lands in example.co.uk, and in dev.example.co.uk if that is a zone of its own.
+func hostnameZone(zones map[string]string, hostname string) (string, string) {
+	name := strings.TrimSuffix(strings.ToLower(hostname), ".")
+	for {
+		if id, ok := zones[name]; ok {
+			return name, id
+		}
+		i := strings.Index(name, ".")
+		if i < 0 {
+			return "", ""
+		}
+		name = name[i+1:]
+	}
 }
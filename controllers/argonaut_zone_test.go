@@ -0,0 +1,219 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cloudflare/cloudflare-go"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Serves /zones of a fake Cloudflare API, paged and filtered by account like the real one, and
+// counts the requests.
+type fakeZonesAPI struct {
+	mu       sync.Mutex
+	zones    []cloudflare.Zone
+	requests []string
+}
+
+func (f *fakeZonesAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req.URL.RawQuery)
+
+	query := req.URL.Query()
+	page, _ := strconv.Atoi(query.Get("page"))
+	perPage, _ := strconv.Atoi(query.Get("per_page"))
+	var matching []cloudflare.Zone
+	for _, zone := range f.zones {
+		if account := query.Get("account.id"); len(account) == 0 || zone.Account.ID == account {
+			matching = append(matching, zone)
+		}
+	}
+	start, end := (page-1)*perPage, page*perPage
+	if start > len(matching) {
+		start = len(matching)
+	}
+	if end > len(matching) {
+		end = len(matching)
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"errors":   []interface{}{},
+		"messages": []interface{}{},
+		"result":   matching[start:end],
+	})
+}
+
+func (f *fakeZonesAPI) add(account string, names ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, name := range names {
+		zone := cloudflare.Zone{ID: fmt.Sprintf("id-%s", name), Name: name}
+		zone.Account.ID = account
+		f.zones = append(f.zones, zone)
+	}
+}
+
+func (f *fakeZonesAPI) requestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+func newFakeZonesClient(t *testing.T, api *fakeZonesAPI, token string, account string) *cloudflare.API {
+	t.Helper()
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	opts := []cloudflare.Option{cloudflare.BaseURL(server.URL)}
+	if len(account) != 0 {
+		opts = append(opts, cloudflare.UsingAccount(account))
+	}
+	cfc, err := cloudflare.NewWithAPIToken(token, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfc
+}
+
+func TestHostnameZone(t *testing.T) {
+	zones := map[string]string{
+		"example.com":     "1",
+		"dev.example.com": "2",
+		"example.co.uk":   "3",
+	}
+	tests := []struct {
+		hostname string
+		zone     string
+	}{
+		{"example.com", "example.com"},
+		{"app.example.com", "example.com"},
+		{"a.b.example.com", "example.com"},
+		{"dev.example.com", "dev.example.com"},
+		{"app.dev.example.com", "dev.example.com"},
+		{"App.Example.COM.", "example.com"},
+		{"*.example.com", "example.com"},
+		{"app.example.co.uk", "example.co.uk"},
+		{"foo.example.com.evil.net", ""},
+		{"example.com.evil.net", ""},
+		{"evilexample.com", ""},
+		{"co.uk", ""},
+		{"com", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			name, id := hostnameZone(zones, tt.hostname)
+			if name != tt.zone || id != zones[tt.zone] {
+				t.Errorf("hostnameZone(%q) = %q, %q, want %q, %q", tt.hostname, name, id, tt.zone, zones[tt.zone])
+			}
+		})
+	}
+}
+
+func TestListZones(t *testing.T) {
+	api := &fakeZonesAPI{}
+	for i := 0; i < 2*zonesPerPage+3; i++ {
+		api.add("ours", fmt.Sprintf("zone%d.example", i))
+	}
+	api.add("theirs", "other.example")
+
+	tests := []struct {
+		name     string
+		account  string
+		zones    int
+		requests int
+	}{
+		{name: "account", account: "ours", zones: 2*zonesPerPage + 3, requests: 3},
+		{name: "other account", account: "theirs", zones: 1, requests: 1},
+		{name: "no account", zones: 2*zonesPerPage + 4, requests: 3},
+		{name: "unknown account", account: "nobody", zones: 0, requests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api.requests = nil
+			zones, err := listZones(context.Background(), newFakeZonesClient(t, api, "token", tt.account))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(zones) != tt.zones {
+				t.Errorf("listed %d zones, want %d", len(zones), tt.zones)
+			}
+			if api.requestCount() != tt.requests {
+				t.Errorf("made %d requests, want %d: %v", api.requestCount(), tt.requests, api.requests)
+			}
+			seen := make(map[string]bool)
+			for _, zone := range zones {
+				if len(tt.account) != 0 && zone.Account.ID != tt.account {
+					t.Errorf("zone %s of account %s listed", zone.Name, zone.Account.ID)
+				}
+				if seen[zone.ID] {
+					t.Errorf("zone %s listed twice", zone.Name)
+				}
+				seen[zone.ID] = true
+			}
+		})
+	}
+}
+
+func TestZoneCache(t *testing.T) {
+	ctx := context.Background()
+	api := &fakeZonesAPI{}
+	api.add("ours", "example.com")
+	cfc := newFakeZonesClient(t, api, "token", "ours")
+	r := &ArgonautReconciler{}
+
+	// Moves the time the zones of the client were fetched back by age.
+	age := func(cfc *cloudflare.API, d time.Duration) {
+		key := zoneCacheKey(cfc)
+		cached := r.zones.accounts[key]
+		cached.fetched = cached.fetched.Add(-d)
+		r.zones.accounts[key] = cached
+	}
+	lookup := func(hostname string, zone string, requests int) {
+		t.Helper()
+		name, _, err := r.ZoneForHostname(ctx, cfc, hostname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != zone {
+			t.Errorf("zone of %s is %q, want %q", hostname, name, zone)
+		}
+		if api.requestCount() != requests {
+			t.Errorf("after looking up %s made %d requests, want %d", hostname, api.requestCount(), requests)
+		}
+	}
+
+	lookup("app.example.com", "example.com", 1)
+	lookup("www.example.com", "example.com", 1)
+
+	// A hostname without zone looks again, but not more than once per zoneCacheRetry.
+	api.add("ours", "example.net")
+	lookup("app.example.net", "", 1)
+	age(cfc, zoneCacheRetry)
+	lookup("app.example.net", "example.net", 2)
+	lookup("app.example.org", "", 2)
+
+	// Known zones are trusted for zoneCacheTTL.
+	age(cfc, zoneCacheTTL-time.Second)
+	lookup("app.example.com", "example.com", 2)
+	age(cfc, time.Second)
+	lookup("app.example.com", "example.com", 3)
+
+	// Another token of the account gets a list of its own.
+	other := newFakeZonesClient(t, api, "other-token", "ours")
+	if _, err := r.Zones(ctx, other, zoneCacheTTL); err != nil {
+		t.Fatal(err)
+	}
+	if api.requestCount() != 4 {
+		t.Errorf("zones of another token made %d requests, want 4", api.requestCount())
+	}
+	if zoneCacheKey(cfc) == zoneCacheKey(other) {
+		t.Errorf("tokens of the same account share cache key %s", zoneCacheKey(cfc))
+	}
+}
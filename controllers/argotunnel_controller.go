@@ -0,0 +1,219 @@
+/*
+Copyright 2021 The Argonaut authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	argonautv1 "github.com/laetho/argonaut/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"sort"
+	"time"
+)
+
+// Conditions making up Ready on an ArgoTunnel.
+var argoTunnelConditions = []string{
+	argonautv1.ConditionTunnelReady,
+	argonautv1.ConditionConfigReady,
+	argonautv1.ConditionDeploymentAvailable,
+}
+
+// ArgoTunnelReconciler reconciles a ArgoTunnel object. It runs the tunnel with the same
+// machinery the ArgonautReconciler uses for Argonauts with a tunnel of their own.
+type ArgoTunnelReconciler struct {
+	*ArgonautReconciler
+}
+
+//+kubebuilder:rbac:groups=argonaut.metalabs.no,resources=argotunnels,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=argonaut.metalabs.no,resources=argotunnels/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=argonaut.metalabs.no,resources=argotunnels/finalizers,verbs=update
+
+// For more details, check Reconcile and its Result here:
+// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.8.3/pkg/reconcile
+func (r *ArgoTunnelReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	_ = log.FromContext(ctx)
+
+	var tunnel argonautv1.ArgoTunnel
+	if err := r.Get(ctx, req.NamespacedName, &tunnel); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		log.FromContext(ctx).Error(err, "unable to fetch ArgoTunnel resource")
+		return ctrl.Result{}, err
+	}
+
+	argonauts, err := r.ListArgoTunnelArgonauts(ctx, &tunnel)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	host := argoTunnelHost(&tunnel, argonauts)
+
+	if !tunnel.DeletionTimestamp.IsZero() {
+		if !controllerutil.ContainsFinalizer(&tunnel, argonautFinalizer) {
+			return ctrl.Result{}, nil
+		}
+		done, err := r.FinalizeTunnelHost(ctx, host)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if !done {
+			return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
+		}
+		controllerutil.RemoveFinalizer(&tunnel, argonautFinalizer)
+		if err := r.Update(ctx, &tunnel); err != nil {
+			return ctrl.Result{}, err
+		}
+		log.FromContext(ctx).Info("finalized ArgoTunnel", "name", tunnel.Name)
+		return ctrl.Result{}, nil
+	}
+
+	if _, err := r.EnsureFinalizer(ctx, &tunnel); err != nil {
+		log.FromContext(ctx).Error(err, "unable to add finalizer", "name", tunnel.Name)
+		return ctrl.Result{}, err
+	}
+
+	result, err := r.ReconcileSharedTunnel(ctx, &tunnel, host)
+
+	tunnel.Status.ObservedGeneration = tunnel.Generation
+	setReadyCondition(&tunnel.Status.Conditions, tunnel.Generation, argoTunnelConditions...)
+	if err := r.Status().Update(ctx, &tunnel); err != nil {
+		log.FromContext(ctx).Error(err, "unable to update status on ArgoTunnel", "name", tunnel.Name)
+		return ctrl.Result{}, err
+	}
+	return result, err
+}
+
+// Runs the tunnel of an ArgoTunnel with the ingress rules of all Argonauts attached to it,
+// setting its conditions along the way.
+func (r *ArgoTunnelReconciler) ReconcileSharedTunnel(ctx context.Context, tunnel *argonautv1.ArgoTunnel, host *tunnelHost) (ctrl.Result, error) {
+	initConditions(&tunnel.Status.Conditions, tunnel.Generation, argoTunnelConditions...)
+
+	cfc, err := r.CloudflareLogin(ctx, tunnel.Spec.CFAuthSecret)
+	if err != nil {
+		r.Recorder.Event(tunnel, v1.EventTypeWarning, eventCloudflareAuthFailed, err.Error())
+		setCondition(&tunnel.Status.Conditions, tunnel.Generation, argonautv1.ConditionTunnelReady, metav1.ConditionFalse, reasonCloudflareLoginFailed, err.Error())
+		return ctrl.Result{}, err
+	}
+	log.FromContext(ctx).Info("reconcile of ArgoTunnel instance", "instance", tunnel.Name, "cfaccount", cfc.AccountID, "argonauts", len(host.Argonauts))
+
+	_, creds, waiting, err := r.ReconcileTunnelHost(ctx, cfc, host)
+	if err != nil {
+		r.recordCloudflareAuthError(tunnel, err)
+		return ctrl.Result{}, err
+	}
+
+	tunnel.Status.Argonauts = nil
+	owners := hostnameOwners(host.Argonauts)
+	for _, argonaut := range host.Argonauts {
+		var hostnames []string
+		for _, hostname := range argonautHostnames(&argonaut) {
+			if ownsHostname(owners, &argonaut, hostname) {
+				hostnames = append(hostnames, hostname)
+			}
+		}
+		tunnel.Status.Argonauts = append(tunnel.Status.Argonauts, argonautv1.ArgoTunnelArgonaut{
+			Namespace: argonaut.Namespace,
+			Name:      argonaut.Name,
+			Hostnames: hostnames,
+		})
+	}
+
+	// DNS records belong to the Argonauts, each acknowledges the move by recording the
+	// tunnel in its status.
+	retiring := len(tunnel.Status.PreviousTunnelId) != 0
+	if argonautsOnTunnel(host.Argonauts, tunnel.Status.TunnelId) {
+		retiring, err = r.RetirePreviousArgoTunnel(ctx, cfc, host, creds)
+		if err != nil {
+			log.FromContext(ctx).Error(err, "unable to retire previous tunnel", "tunnel", tunnel.Status.PreviousTunnelId)
+			return ctrl.Result{}, err
+		}
+	}
+
+	if waiting || retiring {
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// List the Argonauts referencing an ArgoTunnel, leaving out those being deleted and those already
+// running a tunnel of their own by that name. Sorted by namespace and name so the merged
+// cloudflared config is stable.
+func (r *ArgonautReconciler) ListArgoTunnelArgonauts(ctx context.Context, tunnel *argonautv1.ArgoTunnel) ([]argonautv1.Argonaut, error) {
+	var list argonautv1.ArgonautList
+	if err := r.List(ctx, &list, client.MatchingFields{argoTunnelNameField: tunnel.Name}); err != nil {
+		return nil, err
+	}
+
+	var argonauts []argonautv1.Argonaut
+	for _, argonaut := range list.Items {
+		if !argonaut.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if len(argonaut.Status.ArgoTunnel) != 0 || len(argonaut.Status.TunnelId) == 0 {
+			argonauts = append(argonauts, argonaut)
+		}
+	}
+	sort.Slice(argonauts, func(i, j int) bool {
+		if argonauts[i].Namespace != argonauts[j].Namespace {
+			return argonauts[i].Namespace < argonauts[j].Namespace
+		}
+		return argonauts[i].Name < argonauts[j].Name
+	})
+	return argonauts, nil
+}
+
+// Checks that every Argonaut has its DNS pointed at the given tunnel.
+func argonautsOnTunnel(argonauts []argonautv1.Argonaut, tunnelID string) bool {
+	for _, argonaut := range argonauts {
+		if argonaut.Status.TunnelId != tunnelID {
+			return false
+		}
+	}
+	return true
+}
+
+// SetupWithManager sets up the controller with the Manager. Relies on the field indexes set up
+// by the ArgonautReconciler.
+func (r *ArgoTunnelReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&argonautv1.ArgoTunnel{}).
+		Watches(&source.Kind{Type: &argonautv1.Argonaut{}}, handler.EnqueueRequestsFromMapFunc(argoTunnelForArgonaut)).
+		Watches(&source.Kind{Type: &v1.Service{}}, handler.EnqueueRequestsFromMapFunc(r.argoTunnelsForService), builder.WithPredicates(serviceChangedPredicate)).
+		Watches(&source.Kind{Type: &v1.Endpoints{}}, handler.EnqueueRequestsFromMapFunc(r.argoTunnelsForEndpoints)).
+		Watches(&source.Kind{Type: &argonautv1.ServiceGrant{}}, handler.EnqueueRequestsFromMapFunc(r.argoTunnelsForServiceGrant)).
+		Watches(&source.Kind{Type: &v1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.argoTunnelsForSecret)).
+		Watches(&source.Kind{Type: &v1.ConfigMap{}}, handler.EnqueueRequestsFromMapFunc(r.argoTunnelsForConfigMap)).
+		Owns(&appsv1.Deployment{}, builder.WithPredicates(deploymentChangedPredicate)).
+		Owns(&v1.ConfigMap{}).
+		Owns(&v1.Secret{}).
+		Owns(&v1.Service{}, builder.WithPredicates(serviceChangedPredicate)).
+		Owns(&policyv1.PodDisruptionBudget{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Owns(&autoscalingv2.HorizontalPodAutoscaler{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
@@ -52,11 +52,20 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var clusterDomain string
+	var cloudflaredImage string
+	var clusterID string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&clusterDomain, "cluster-domain", "cluster.local",
+		"DNS domain of the cluster, used in the Service addresses written to the cloudflared config.")
+	flag.StringVar(&cloudflaredImage, "cloudflared-image", controllers.DefaultCloudflaredImage,
+		"cloudflared image for tunnels that don't set one in their deployment settings.")
+	flag.StringVar(&clusterID, "cluster-id", "default",
+		"Identifies this cluster in the TXT records claiming DNS records. Must be unique among clusters sharing zones.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -78,13 +87,35 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = (&controllers.ArgonautReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
+	argonautReconciler := &controllers.ArgonautReconciler{
+		Client:        mgr.GetClient(),
+		Scheme:        mgr.GetScheme(),
+		Recorder:      mgr.GetEventRecorderFor("argonaut"),
+		ClusterDomain: clusterDomain,
+		DefaultImage:  cloudflaredImage,
+		ClusterID:     clusterID,
+	}
+	if err = argonautReconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Argonaut")
 		os.Exit(1)
 	}
+	if err = (&controllers.ArgoTunnelReconciler{
+		ArgonautReconciler: argonautReconciler,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ArgoTunnel")
+		os.Exit(1)
+	}
+	// Served only where config/default has the [WEBHOOK] sections enabled, see manager_webhook_patch.yaml.
+	if os.Getenv("ENABLE_WEBHOOKS") == "true" {
+		if err = (&argonautv1.Argonaut{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Argonaut")
+			os.Exit(1)
+		}
+		if err = (&argonautv1.ArgoTunnel{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "ArgoTunnel")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {